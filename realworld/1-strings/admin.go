@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gofiber/fiber/v2"
+)
+
+// adminAuth only lets through requests carrying "Authorization: Bearer <token>".
+// With an empty token every admin request is refused.
+func adminAuth(token string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		given := strings.TrimPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid admin token"})
+		}
+		return c.Next()
+	}
+}
+
+// parseAdminIP canonicalizes an IP from the URL the same way cache keys are built
+func parseAdminIP(s string) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(strings.TrimSpace(s))
+	if err != nil {
+		return netip.Addr{}, errInvalidIP
+	}
+	return addr.Unmap(), nil
+}
+
+// adminKey returns the cache key for an IP from the URL, or for "self",
+// the entry of the server's own address
+func adminKey(s string) (string, error) {
+	if s == strings.TrimPrefix(KEY_MYIP, geoIPKeyPrefix) {
+		return KEY_MYIP, nil
+	}
+	addr, err := parseAdminIP(s)
+	if err != nil {
+		return "", err
+	}
+	return geoIPKey(addr), nil
+}
+
+// listCachedIPs pages through the cached IPs with SCAN; pass next_cursor back
+// as cursor until it comes back as "0"
+func listCachedIPs(c *fiber.Ctx, ctx context.Context, cache *GeoIPCache) error {
+	cursor, err := strconv.ParseUint(c.Query("cursor", "0"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid cursor"})
+	}
+	count, err := strconv.ParseInt(c.Query("count", "100"), 10, 64)
+	if err != nil || count <= 0 || count > 1000 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "count must be between 1 and 1000"})
+	}
+
+	keys, next, err := cache.rdb.Scan(ctx, cursor, geoIPKeyPrefix+"*", count).Result()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	ips := make([]string, 0, len(keys))
+	for _, key := range keys {
+		ips = append(ips, strings.TrimPrefix(key, geoIPKeyPrefix))
+	}
+
+	return c.JSON(fiber.Map{
+		"ips":         ips,
+		"next_cursor": strconv.FormatUint(next, 10),
+	})
+}
+
+// getCachedIP shows one cache entry, or the failed lookup remembered for it, with its remaining TTL
+func getCachedIP(c *fiber.Ctx, ctx context.Context, cache *GeoIPCache) error {
+	key, err := adminKey(c.Params("ip"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	ip := strings.TrimPrefix(key, geoIPKeyPrefix)
+
+	pipe := cache.rdb.Pipeline()
+	getCmd := pipe.Get(ctx, key)
+	ttlCmd := pipe.PTTL(ctx, key)
+	negCmd := pipe.Get(ctx, negativeKey(key))
+	negTTLCmd := pipe.PTTL(ctx, negativeKey(key))
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	if value, err := getCmd.Bytes(); err == nil {
+		ipAddress, err := cache.Codec.Decode(value)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to decode cached IP information"})
+		}
+		return c.JSON(fiber.Map{
+			"ip":          ip,
+			"ttl_seconds": int64(ttlCmd.Val().Seconds()),
+			"data":        ipAddress,
+		})
+	}
+
+	if message, err := negCmd.Result(); err == nil {
+		return c.JSON(fiber.Map{
+			"ip":          ip,
+			"ttl_seconds": int64(negTTLCmd.Val().Seconds()),
+			"error":       message,
+		})
+	}
+
+	return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "IP is not cached"})
+}
+
+// purgeCachedIP drops one cache entry together with any remembered failed lookup,
+// and takes the IP out of the geo index
+func purgeCachedIP(c *fiber.Ctx, ctx context.Context, cache *GeoIPCache) error {
+	key, err := adminKey(c.Params("ip"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	pipe := cache.rdb.TxPipeline()
+	delCmd := pipe.Del(ctx, key, negativeKey(key))
+	// The entry for the server's own address shares its geo member with the IP's own entry
+	var zremCmd *redis.IntCmd
+	if key != KEY_MYIP {
+		zremCmd = pipe.ZRem(ctx, geoIndexKey, strings.TrimPrefix(key, geoIPKeyPrefix))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	purged := delCmd.Val()
+	if purged == 0 && (zremCmd == nil || zremCmd.Val() == 0) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "IP is not cached"})
+	}
+	if err := cache.Invalidate(ctx, key); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(fiber.Map{"purged": purged})
+}
+
+// purgeCachedRange drops every entry whose IP falls inside the ?cidr= range
+// and takes those IPs out of the geo index
+func purgeCachedRange(c *fiber.Ctx, ctx context.Context, cache *GeoIPCache) error {
+	prefix, err := netip.ParsePrefix(c.Query("cidr"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid cidr"})
+	}
+	prefix = prefix.Masked()
+
+	var purged int64
+	for _, keyPrefix := range []string{geoIPKeyPrefix, negativeKey(geoIPKeyPrefix)} {
+		iter := cache.rdb.Scan(ctx, 0, keyPrefix+"*", 500).Iterator()
+		keys := []string{}
+		for iter.Next(ctx) {
+			addr, err := netip.ParseAddr(strings.TrimPrefix(iter.Val(), keyPrefix))
+			if err == nil && prefix.Contains(addr) {
+				keys = append(keys, iter.Val())
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		if len(keys) > 0 {
+			n, err := cache.rdb.Del(ctx, keys...).Result()
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+			}
+			purged += n
+			if err := cache.Invalidate(ctx, keys...); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+			}
+		}
+	}
+
+	// The geo index outlives cache entries, so search it rather than the keys just purged
+	members := []string{}
+	iter := cache.rdb.ZScan(ctx, geoIndexKey, 0, "", 500).Iterator()
+	for isMember := true; iter.Next(ctx); isMember = !isMember {
+		// ZSCAN returns members and scores in turn
+		if !isMember {
+			continue
+		}
+		if addr, err := netip.ParseAddr(iter.Val()); err == nil && prefix.Contains(addr.Unmap()) {
+			members = append(members, iter.Val())
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	if len(members) > 0 {
+		if err := cache.rdb.ZRem(ctx, geoIndexKey, members).Err(); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+
+	return c.JSON(fiber.Map{"purged": purged})
+}
+
+// warmCache resolves an uploaded list of IPs so later lookups are hits.
+// The list is either a multipart "file" with one IP per line or a JSON body like /findip/batch.
+func warmCache(c *fiber.Ctx, ctx context.Context, cache *GeoIPCache, provider GeoIPProvider) error {
+	ips := []string{}
+
+	if fileHeader, err := c.FormFile("file"); err == nil {
+		file, err := fileHeader.Open()
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Failed to read uploaded file"})
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+				ips = append(ips, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Failed to read uploaded file"})
+		}
+	} else {
+		batch := GeoIPBatch{}
+		if err := c.BodyParser(&batch); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid input JSON"})
+		}
+		ips = batch.IPs
+	}
+
+	// Resolve in batch-sized chunks and report how many IPs ended in each status
+	counts := map[string]int{}
+	for start := 0; start < len(ips); start += maxBatchSize {
+		end := min(start+maxBatchSize, len(ips))
+		results, err := resolveBatch(ctx, cache, provider, ips[start:end])
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		for _, result := range results {
+			counts[result.Status]++
+		}
+	}
+
+	return c.JSON(fiber.Map{"total": len(ips), "statuses": counts})
+}
+
+// cacheStats reports hit and miss counters for each cache tier of this instance
+func cacheStats(c *fiber.Ctx, cache *GeoIPCache) error {
+	return c.JSON(cache.Stats())
+}
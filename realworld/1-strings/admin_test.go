@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestAdminKey(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{in: "self", want: KEY_MYIP},
+		{in: "8.8.8.8", want: geoIPKeyPrefix + "8.8.8.8"},
+		{in: "::ffff:1.1.1.1", want: geoIPKeyPrefix + "1.1.1.1"},
+	}
+	for _, tt := range tests {
+		if got, err := adminKey(tt.in); err != nil || got != tt.want {
+			t.Errorf("adminKey(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+	if _, err := adminKey("myIP"); err == nil {
+		t.Error("adminKey accepted a name that is not an IP")
+	}
+}
+
+func TestPurgeRemovesFromGeoIndex(t *testing.T) {
+	app, mr, cache, _ := newTestApp(t)
+	ctx := context.Background()
+	app.Delete("/entries/:ip", func(c *fiber.Ctx) error {
+		return purgeCachedIP(c, ctx, cache)
+	})
+	app.Delete("/entries", func(c *fiber.Ctx) error {
+		return purgeCachedRange(c, ctx, cache)
+	})
+	purge := func(target string) int {
+		resp, err := app.Test(httptest.NewRequest(http.MethodDelete, target, nil), -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	findIP(t, app, "8.8.8.8")
+	findIP(t, app, "1.1.1.1")
+	if members, _ := mr.ZMembers(geoIndexKey); len(members) != 2 {
+		t.Fatalf("geo index = %v", members)
+	}
+
+	if status := purge("/entries/8.8.8.8"); status != fiber.StatusOK {
+		t.Fatalf("purge IP: %d", status)
+	}
+	if members, _ := mr.ZMembers(geoIndexKey); len(members) != 1 || members[0] != "1.1.1.1" {
+		t.Errorf("after purging 8.8.8.8: geo index = %v", members)
+	}
+
+	// The cache entry may be gone already while the geo index still has the IP
+	mr.Del(geoIPKeyPrefix + "1.1.1.1")
+	if status := purge("/entries?cidr=1.1.0.0/16"); status != fiber.StatusOK {
+		t.Fatalf("purge range: %d", status)
+	}
+	if mr.Exists(geoIndexKey) {
+		members, _ := mr.ZMembers(geoIndexKey)
+		t.Errorf("after purging 1.1.0.0/16: geo index = %v", members)
+	}
+}
+
+func TestRememberLoginKeepsRecentLocations(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	ctx := context.Background()
+
+	keys := []string{geoLoginsKey("alice"), geoLoginsSeenKey("alice")}
+	for i := 0; i < maxLoginLocations+2; i++ {
+		args := []interface{}{float64(i), 10.0, fmt.Sprintf("1.1.1.%d", i), i, maxLoginLocations, loginRetention.Milliseconds()}
+		if err := rememberLoginScript.Run(ctx, rdb, keys, args...).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	members, _ := mr.ZMembers(keys[0])
+	if len(members) != maxLoginLocations {
+		t.Errorf("%d locations remembered, want %d", len(members), maxLoginLocations)
+	}
+	for _, member := range members {
+		if member == "1.1.1.0" || member == "1.1.1.1" {
+			t.Errorf("least recently used location %s kept", member)
+		}
+	}
+	for _, key := range keys {
+		if ttl := mr.TTL(key); ttl != loginRetention {
+			t.Errorf("%s expires in %v, want %v", key, ttl, loginRetention)
+		}
+	}
+}
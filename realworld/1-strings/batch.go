@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Most IPs accepted by /findip/batch in one call
+const maxBatchSize = 1000
+
+// Per-item status of a batch lookup
+const (
+	BatchHit     = "hit"     // served from the cache
+	BatchMiss    = "miss"    // fetched upstream and cached
+	BatchInvalid = "invalid" // not a public IP address
+	BatchFailed  = "failed"  // the provider could not resolve the IP
+	BatchError   = "error"   // the provider was unavailable
+)
+
+// Struct for batch GeoIP input
+type GeoIPBatch struct {
+	IPs []string `json:"ips"`
+}
+
+// Result for one IP of a batch, in input order
+type GeoIPBatchResult struct {
+	IP     string     `json:"ip"`
+	Status string     `json:"status"`
+	Error  string     `json:"error,omitempty"`
+	Data   *IPAddress `json:"data,omitempty"`
+}
+
+func findIPBatch(c *fiber.Ctx, ctx context.Context, cache *GeoIPCache, provider GeoIPProvider, stats *GeoStats) error {
+	batch := GeoIPBatch{}
+
+	if err := c.BodyParser(&batch); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid input JSON"})
+	}
+	if len(batch.IPs) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "At least one IP is required"})
+	}
+	if len(batch.IPs) > maxBatchSize {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Too many IPs in one batch"})
+	}
+
+	results, err := resolveBatch(ctx, cache, provider, batch.IPs)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	resolved := []IPAddress{}
+	for _, result := range results {
+		if result.Data != nil {
+			resolved = append(resolved, *result.Data)
+		}
+	}
+	stats.Record(resolved...)
+
+	return c.JSON(results)
+}
+
+// resolveBatch looks up ips, serving hits from a single MGET, fetching only
+// the misses upstream and writing them back in one pipeline
+func resolveBatch(ctx context.Context, cache *GeoIPCache, provider GeoIPProvider, ips []string) ([]GeoIPBatchResult, error) {
+	// Validate every IP and collect each distinct key once, remembering
+	// which input positions it answers
+	results := make([]GeoIPBatchResult, len(ips))
+	keys := []string{}
+	addrs := []string{}
+	positions := map[string][]int{}
+	for i, ip := range ips {
+		results[i].IP = ip
+
+		addr, err := parsePublicIP(ip)
+		if err != nil {
+			results[i].Status = BatchInvalid
+			results[i].Error = err.Error()
+			continue
+		}
+
+		key := geoIPKey(addr)
+		if _, seen := positions[key]; !seen {
+			keys = append(keys, key)
+			addrs = append(addrs, addr.String())
+		}
+		positions[key] = append(positions[key], i)
+	}
+
+	// fill copies one outcome to every input position of key
+	fill := func(key, status, message string, ipAddress *IPAddress) {
+		for _, i := range positions[key] {
+			results[i].Status = status
+			results[i].Error = message
+			results[i].Data = ipAddress
+		}
+	}
+
+	if len(keys) == 0 {
+		return results, nil
+	}
+
+	values, failures, err := cache.GetMany(ctx, keys)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve cached IP information: %w", err)
+	}
+
+	missKeys := []string{}
+	missIPs := []string{}
+	for j, key := range keys {
+		switch {
+		case values[j] != nil:
+			fill(key, BatchHit, "", values[j])
+		case failures[j] != nil:
+			fill(key, BatchFailed, failures[j].Message, nil)
+		default:
+			missKeys = append(missKeys, key)
+			missIPs = append(missIPs, addrs[j])
+		}
+	}
+
+	if len(missKeys) == 0 {
+		return results, nil
+	}
+
+	ipAddresses, errs := lookupBatch(ctx, provider, missIPs)
+	fresh := map[string]IPAddress{}
+	negative := map[string]*LookupError{}
+	for j, key := range missKeys {
+		if lookupErr, ok := isLookupError(errs[j]); ok {
+			negative[key] = lookupErr
+			fill(key, BatchFailed, lookupErr.Message, nil)
+			continue
+		}
+		if rateLimitErr, ok := isRateLimitError(errs[j]); ok {
+			fill(key, BatchError, rateLimitErr.Error(), nil)
+			continue
+		}
+		if errs[j] != nil {
+			fill(key, BatchError, "Failed to fetch IP information", nil)
+			continue
+		}
+
+		fresh[key] = ipAddresses[j]
+		fill(key, BatchMiss, "", &ipAddresses[j])
+	}
+
+	if err := cache.SetMany(ctx, fresh, negative); err != nil {
+		return nil, fmt.Errorf("cache IP information: %w", err)
+	}
+
+	return results, nil
+}
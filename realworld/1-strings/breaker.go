@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+var errCircuitOpen = errors.New("upstream circuit breaker is open")
+
+// The breaker keeps its state in three keys so every instance trips together:
+//   - open: present while the breaker is open
+//   - failures: recent failures; at or over the threshold without the open
+//     key the breaker is half-open
+//   - probe: held by the one instance allowed to try the upstream while half-open
+var breakerAllowScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return 0
+end
+local failures = tonumber(redis.call("GET", KEYS[2]) or "0")
+if failures < tonumber(ARGV[1]) then
+	return 1
+end
+if redis.call("SET", KEYS[3], "1", "NX", "PX", ARGV[2]) then
+	return 1
+end
+return 0
+`)
+
+var breakerFailureScript = redis.NewScript(`
+local failures = redis.call("INCR", KEYS[2])
+if failures == 1 then
+	redis.call("PEXPIRE", KEYS[2], ARGV[2])
+end
+redis.call("DEL", KEYS[3])
+if failures >= tonumber(ARGV[1]) then
+	redis.call("SET", KEYS[1], "1", "PX", ARGV[3])
+	redis.call("PEXPIRE", KEYS[2], tonumber(ARGV[3]) + tonumber(ARGV[2]))
+end
+return failures
+`)
+
+// CircuitBreaker stops calling an upstream that keeps failing. After Threshold
+// failures within Window it opens for OpenFor, then lets a single probe
+// through; a successful probe closes it again, a failed one reopens it.
+type CircuitBreaker struct {
+	rdb       *redis.Client
+	keys      []string
+	Threshold int
+	Window    time.Duration
+	OpenFor   time.Duration
+	ProbeTTL  time.Duration // how long a half-open probe may take before another is allowed
+}
+
+func NewCircuitBreaker(rdb *redis.Client, name string, threshold int, window, openFor time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		rdb:       rdb,
+		keys:      []string{name + ":open", name + ":failures", name + ":probe"},
+		Threshold: threshold,
+		Window:    window,
+		OpenFor:   openFor,
+		ProbeTTL:  10 * time.Second,
+	}
+}
+
+// Allow returns errCircuitOpen unless the breaker lets a request through
+func (cb *CircuitBreaker) Allow(ctx context.Context) error {
+	allowed, err := breakerAllowScript.Run(ctx, cb.rdb, cb.keys, cb.Threshold, cb.ProbeTTL.Milliseconds()).Int()
+	if err != nil {
+		return err
+	}
+	if allowed == 0 {
+		return errCircuitOpen
+	}
+	return nil
+}
+
+// Record reports the outcome of a request Allow let through
+func (cb *CircuitBreaker) Record(ctx context.Context, success bool) error {
+	if success {
+		return cb.rdb.Del(ctx, cb.keys[1], cb.keys[2]).Err()
+	}
+	return breakerFailureScript.Run(ctx, cb.rdb, cb.keys, cb.Threshold, cb.Window.Milliseconds(), cb.OpenFor.Milliseconds()).Err()
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/gofiber/fiber/v2"
+)
+
+func newTestBreaker(t *testing.T) (*miniredis.Miniredis, *CircuitBreaker) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	return mr, NewCircuitBreaker(rdb, "test:breaker", 3, time.Minute, 30*time.Second)
+}
+
+// failUntilOpen records failures until the breaker opens
+func failUntilOpen(t *testing.T, cb *CircuitBreaker) {
+	t.Helper()
+	ctx := context.Background()
+	for i := 0; i < cb.Threshold; i++ {
+		if err := cb.Allow(ctx); err != nil {
+			t.Fatalf("failure %d: Allow = %v", i+1, err)
+		}
+		if err := cb.Record(ctx, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBreakerOpensAtThreshold(t *testing.T) {
+	mr, cb := newTestBreaker(t)
+	ctx := context.Background()
+
+	for i := 0; i < cb.Threshold-1; i++ {
+		if err := cb.Record(ctx, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cb.Allow(ctx); err != nil {
+		t.Fatalf("below the threshold: Allow = %v", err)
+	}
+
+	if err := cb.Record(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := cb.Allow(ctx); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("at the threshold: Allow = %v, want %v", err, errCircuitOpen)
+	}
+	if ttl := mr.TTL("test:breaker:open"); ttl != cb.OpenFor {
+		t.Errorf("open for %v, want %v", ttl, cb.OpenFor)
+	}
+}
+
+func TestBreakerSuccessResetsFailures(t *testing.T) {
+	_, cb := newTestBreaker(t)
+	ctx := context.Background()
+
+	for i := 0; i < cb.Threshold-1; i++ {
+		cb.Record(ctx, false)
+	}
+	cb.Record(ctx, true)
+	cb.Record(ctx, false)
+	if err := cb.Allow(ctx); err != nil {
+		t.Errorf("failures before a success counted: Allow = %v", err)
+	}
+}
+
+func TestOpenBreakerAnswers503(t *testing.T) {
+	app, mr, _, provider := newTestApp(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	cb := NewCircuitBreaker(rdb, "test:breaker", 3, time.Minute, 30*time.Second)
+	provider.GeoIPProvider.(*IPAPIProvider).Breaker = cb
+	failUntilOpen(t, cb)
+
+	status, _, body := findIP(t, app, "8.8.8.8")
+	if status != fiber.StatusServiceUnavailable {
+		t.Errorf("lookup: %d %v, want 503", status, body)
+	}
+}
+
+func TestHalfOpenProbeSuccessCloses(t *testing.T) {
+	mr, cb := newTestBreaker(t)
+	ctx := context.Background()
+	failUntilOpen(t, cb)
+	mr.FastForward(cb.OpenFor)
+
+	// Half-open: one probe goes through, everyone else waits for it
+	if err := cb.Allow(ctx); err != nil {
+		t.Fatalf("probe: Allow = %v", err)
+	}
+	if err := cb.Allow(ctx); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("during the probe: Allow = %v, want %v", err, errCircuitOpen)
+	}
+
+	if err := cb.Record(ctx, true); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < cb.Threshold; i++ {
+		if err := cb.Allow(ctx); err != nil {
+			t.Fatalf("after a good probe: Allow = %v", err)
+		}
+	}
+	if mr.Exists("test:breaker:failures") || mr.Exists("test:breaker:probe") {
+		t.Error("a good probe left breaker state behind")
+	}
+}
+
+func TestHalfOpenProbeFailureReopens(t *testing.T) {
+	mr, cb := newTestBreaker(t)
+	ctx := context.Background()
+	failUntilOpen(t, cb)
+	mr.FastForward(cb.OpenFor)
+
+	if err := cb.Allow(ctx); err != nil {
+		t.Fatalf("probe: Allow = %v", err)
+	}
+	if err := cb.Record(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := cb.Allow(ctx); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("after a failed probe: Allow = %v, want %v", err, errCircuitOpen)
+	}
+	if ttl := mr.TTL("test:breaker:open"); ttl != cb.OpenFor {
+		t.Errorf("reopened for %v, want %v", ttl, cb.OpenFor)
+	}
+	if mr.Exists("test:breaker:probe") {
+		t.Error("a failed probe kept the probe key")
+	}
+}
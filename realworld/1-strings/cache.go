@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Cache states reported in the X-Cache response header
+const (
+	CacheHit   = "HIT"
+	CacheStale = "STALE"
+	CacheMiss  = "MISS"
+)
+
+// GeoIPCache stores upstream GeoIP answers in Redis.
+// An entry is fresh for FreshTTL and may then be served stale for StaleTTL
+// while it is refreshed in the background.
+type GeoIPCache struct {
+	rdb      *redis.Client
+	FreshTTL time.Duration
+	StaleTTL time.Duration
+
+	// NegativeTTL is how long failed lookups are remembered
+	NegativeTTL time.Duration
+
+	// LockTTL enables the cross-instance fetch lock when positive;
+	// waiters check every LockPoll whether the holder has finished
+	LockTTL  time.Duration
+	LockPoll time.Duration
+
+	// Codec encodes the values stored in Redis
+	Codec Codec
+
+	// RefreshAhead tracks popularity and shadow keys for the Refresher
+	RefreshAhead bool
+	hitsMu       sync.Mutex
+	hits         map[string]float64 // requests per key not yet added to popularityKey
+
+	// Optional in-process tier in front of Redis; see EnableLocalCache
+	local      *localCache
+	instanceID string
+	localStats tierStats
+	redisStats tierStats
+
+	flights    flightGroup
+	refreshing sync.Map // keys with a background refresh in progress
+}
+
+func NewGeoIPCache(rdb *redis.Client, freshTTL, staleTTL time.Duration) *GeoIPCache {
+	return &GeoIPCache{
+		rdb:         rdb,
+		FreshTTL:    freshTTL,
+		StaleTTL:    staleTTL,
+		NegativeTTL: 5 * time.Minute,
+		LockPoll:    50 * time.Millisecond,
+	}
+}
+
+// negativeKey is where a failed lookup for key is remembered
+func negativeKey(key string) string {
+	return "neg:" + key
+}
+
+// Get returns the cached value for key together with its cache state.
+// A missing or undecodable value is reported as CacheMiss, and a
+// remembered failed lookup as CacheHit with a *LookupError.
+func (gc *GeoIPCache) Get(ctx context.Context, key string) (IPAddress, string, error) {
+	if gc.local != nil {
+		ipAddress, ok := gc.local.Get(key)
+		gc.localStats.record(ok)
+		if ok {
+			return ipAddress, CacheHit, nil
+		}
+	}
+
+	// Read the value, its remaining TTL and any failed lookup in a single round trip
+	pipe := gc.rdb.Pipeline()
+	getCmd := pipe.Get(ctx, key)
+	ttlCmd := pipe.PTTL(ctx, key)
+	negCmd := pipe.Get(ctx, negativeKey(key))
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return IPAddress{}, "", err
+	}
+
+	value, err := getCmd.Bytes()
+	if err == redis.Nil {
+		if message, err := negCmd.Result(); err == nil {
+			gc.redisStats.record(true)
+			return IPAddress{}, CacheHit, &LookupError{Message: message}
+		}
+		gc.redisStats.record(false)
+		return IPAddress{}, CacheMiss, nil
+	}
+	if err != nil {
+		return IPAddress{}, "", err
+	}
+
+	// Values written by an older schema are simply fetched again
+	ipAddress, err := gc.Codec.Decode(value)
+	gc.redisStats.record(err == nil)
+	if err != nil {
+		return IPAddress{}, CacheMiss, nil
+	}
+
+	// Once the remaining TTL falls inside the stale window the entry is stale.
+	// Negative TTLs mean the key has no expiry and is always fresh.
+	if ttl := ttlCmd.Val(); ttl >= 0 && ttl <= gc.StaleTTL {
+		return ipAddress, CacheStale, nil
+	}
+	gc.local.Set(key, ipAddress)
+	return ipAddress, CacheHit, nil
+}
+
+// Set stores ipAddress under key for the fresh TTL plus the stale window
+func (gc *GeoIPCache) Set(ctx context.Context, key string, ipAddress IPAddress) error {
+	value, err := gc.Codec.Encode(ipAddress)
+	if err != nil {
+		return err
+	}
+	pipe := gc.rdb.Pipeline()
+	gc.queueSet(ctx, pipe, key, value)
+	queueGeoAdd(ctx, pipe, ipAddress)
+	pipe.Publish(ctx, invalidationChannel, gc.instanceID+" "+key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	gc.local.Set(key, ipAddress)
+	return nil
+}
+
+// queueSet adds the commands that store value under key to pipe. With refresh
+// ahead enabled a shadow key expires when the entry turns stale, so the
+// refresher hears about it while the entry can still be served.
+func (gc *GeoIPCache) queueSet(ctx context.Context, pipe redis.Pipeliner, key string, value []byte) {
+	pipe.Set(ctx, key, value, gc.FreshTTL+gc.StaleTTL)
+	if gc.RefreshAhead && gc.FreshTTL > 0 {
+		pipe.Set(ctx, refreshKey(key), "", gc.FreshTTL)
+	}
+}
+
+// SetNegative remembers a failed lookup for key for NegativeTTL,
+// dropping any older successful answer
+func (gc *GeoIPCache) SetNegative(ctx context.Context, key string, lookupErr *LookupError) error {
+	pipe := gc.rdb.TxPipeline()
+	pipe.Del(ctx, key)
+	pipe.Set(ctx, negativeKey(key), lookupErr.Message, gc.NegativeTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	gc.local.Delete(key)
+	return gc.publishInvalidation(ctx, key)
+}
+
+// GetMany reads many keys with a single MGET. For each key it returns the
+// cached value, or the remembered failed lookup, or neither on a miss.
+// Unlike Get it does not tell fresh entries from stale ones.
+func (gc *GeoIPCache) GetMany(ctx context.Context, keys []string) ([]*IPAddress, []*LookupError, error) {
+	values := make([]*IPAddress, len(keys))
+	failures := make([]*LookupError, len(keys))
+
+	// Serve what we can from the local tier and only ask Redis for the rest
+	remote := []int{}
+	for i, key := range keys {
+		if gc.local == nil {
+			remote = append(remote, i)
+			continue
+		}
+		ipAddress, ok := gc.local.Get(key)
+		gc.localStats.record(ok)
+		if ok {
+			values[i] = &ipAddress
+		} else {
+			remote = append(remote, i)
+		}
+	}
+	if len(remote) == 0 {
+		return values, failures, nil
+	}
+
+	mgetKeys := make([]string, 0, 2*len(remote))
+	for _, i := range remote {
+		mgetKeys = append(mgetKeys, keys[i])
+	}
+	for _, i := range remote {
+		mgetKeys = append(mgetKeys, negativeKey(keys[i]))
+	}
+
+	results, err := gc.rdb.MGet(ctx, mgetKeys...).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for j, i := range remote {
+		if value, ok := results[j].(string); ok {
+			ipAddress, err := gc.Codec.Decode([]byte(value))
+			gc.redisStats.record(err == nil)
+			if err == nil {
+				values[i] = &ipAddress
+				gc.local.Set(keys[i], ipAddress)
+			}
+		} else if message, ok := results[len(remote)+j].(string); ok {
+			gc.redisStats.record(true)
+			failures[i] = &LookupError{Message: message}
+		} else {
+			gc.redisStats.record(false)
+		}
+	}
+	return values, failures, nil
+}
+
+// SetMany stores values and failed lookups in one pipeline
+func (gc *GeoIPCache) SetMany(ctx context.Context, values map[string]IPAddress, failures map[string]*LookupError) error {
+	pipe := gc.rdb.Pipeline()
+	for key, ipAddress := range values {
+		value, err := gc.Codec.Encode(ipAddress)
+		if err != nil {
+			return err
+		}
+		gc.queueSet(ctx, pipe, key, value)
+		queueGeoAdd(ctx, pipe, ipAddress)
+	}
+	for key, lookupErr := range failures {
+		pipe.Del(ctx, key)
+		pipe.Set(ctx, negativeKey(key), lookupErr.Message, gc.NegativeTTL)
+	}
+	for key := range values {
+		pipe.Publish(ctx, invalidationChannel, gc.instanceID+" "+key)
+	}
+	for key := range failures {
+		pipe.Publish(ctx, invalidationChannel, gc.instanceID+" "+key)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	for key, ipAddress := range values {
+		gc.local.Set(key, ipAddress)
+	}
+	for key := range failures {
+		gc.local.Delete(key)
+	}
+	return nil
+}
+
+// Revalidate refreshes key in the background using fetch.
+// Only one refresh per key runs at a time; extra calls return immediately.
+// If the upstream is down the stale entry is kept for another stale window.
+func (gc *GeoIPCache) Revalidate(ctx context.Context, key string, fetch func() (IPAddress, error)) {
+	if _, running := gc.refreshing.LoadOrStore(key, struct{}{}); running {
+		return
+	}
+
+	go func() {
+		defer gc.refreshing.Delete(key)
+
+		_, err := gc.Fetch(ctx, key, fetch)
+		if err == nil {
+			return
+		}
+		log.Printf("revalidate %s: %v", key, err)
+
+		// While the upstream is unavailable keep serving the stale entry
+		// for another stale window instead of letting it expire
+		if _, ok := isLookupError(err); !ok && gc.StaleTTL > 0 {
+			if err := gc.rdb.PExpire(ctx, key, gc.StaleTTL).Err(); err != nil {
+				log.Printf("revalidate %s: %v", key, err)
+			}
+		}
+	}()
+}
+
+// Channel on which instances announce keys they changed, as "<instance id> <key>"
+const invalidationChannel = "geoip:invalidate"
+
+// EnableLocalCache puts a bounded in-process tier of capacity entries, each
+// kept for ttl, in front of Redis. Call ListenInvalidations so copies are
+// dropped when another instance changes a key.
+func (gc *GeoIPCache) EnableLocalCache(capacity int, ttl time.Duration) error {
+	instanceID, err := newRandomToken()
+	if err != nil {
+		return err
+	}
+	gc.local = newLocalCache(capacity, ttl)
+	gc.instanceID = instanceID
+	return nil
+}
+
+// Invalidate drops key from the local tier of every instance, including this one
+func (gc *GeoIPCache) Invalidate(ctx context.Context, keys ...string) error {
+	for _, key := range keys {
+		gc.local.Delete(key)
+		if err := gc.publishInvalidation(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (gc *GeoIPCache) publishInvalidation(ctx context.Context, key string) error {
+	return gc.rdb.Publish(ctx, invalidationChannel, gc.instanceID+" "+key).Err()
+}
+
+// ListenInvalidations drops local copies of keys changed by other instances until ctx is done
+func (gc *GeoIPCache) ListenInvalidations(ctx context.Context) {
+	if gc.local == nil {
+		return
+	}
+
+	pubsub := gc.rdb.Subscribe(ctx, invalidationChannel)
+	defer pubsub.Close()
+	messages := pubsub.Channel()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			instanceID, key, _ := strings.Cut(msg.Payload, " ")
+			if instanceID != gc.instanceID {
+				gc.local.Delete(key)
+			}
+		}
+	}
+}
+
+// Stats reports hits and misses per cache tier
+func (gc *GeoIPCache) Stats() map[string]map[string]int64 {
+	stats := map[string]map[string]int64{"redis": gc.redisStats.snapshot()}
+	if gc.local != nil {
+		stats["local"] = gc.localStats.snapshot()
+	}
+	return stats
+}
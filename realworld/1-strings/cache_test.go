@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/gofiber/fiber/v2"
+)
+
+// countingProvider counts the lookups that reach the provider it wraps
+type countingProvider struct {
+	GeoIPProvider
+	calls atomic.Int32
+}
+
+func (p *countingProvider) Lookup(ctx context.Context, ip string) (IPAddress, error) {
+	p.calls.Add(1)
+	return p.GeoIPProvider.Lookup(ctx, ip)
+}
+
+// newTestApp serves /findipcache2 from a cache in miniredis backed by the fake provider
+func newTestApp(t *testing.T) (*fiber.App, *miniredis.Miniredis, *GeoIPCache, *countingProvider) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	server := NewFakeIPAPIServer(sampleIPAddresses)
+	t.Cleanup(server.Close)
+	provider := &countingProvider{GeoIPProvider: NewIPAPIProvider(server.URL+"/json/", server.URL+"/batch")}
+
+	ctx := context.Background()
+	cache := NewGeoIPCache(rdb, time.Hour, time.Minute)
+	stats := NewGeoStats(rdb, time.Hour)
+
+	app := fiber.New()
+	app.Post("/findipcache2", func(c *fiber.Ctx) error {
+		return findIPCache2(c, ctx, cache, provider, stats)
+	})
+	return app, mr, cache, provider
+}
+
+// findIP posts ip to /findipcache2 and returns the status, X-Cache header and decoded body
+func findIP(t *testing.T, app *fiber.App, ip string) (int, string, map[string]interface{}) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/findipcache2", strings.NewReader(`{"ip":"`+ip+`"}`))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body := map[string]interface{}{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, resp.Header.Get("X-Cache"), body
+}
+
+func TestServeCachedMissThenHit(t *testing.T) {
+	app, mr, _, provider := newTestApp(t)
+
+	status, state, body := findIP(t, app, "8.8.8.8")
+	if status != fiber.StatusOK || state != CacheMiss || body["country"] != "United States" {
+		t.Fatalf("first lookup: %d %s %v", status, state, body)
+	}
+	if !mr.Exists(geoIPKeyPrefix + "8.8.8.8") {
+		t.Error("answer was not cached")
+	}
+
+	status, state, body = findIP(t, app, "8.8.8.8")
+	if status != fiber.StatusOK || state != CacheHit || body["city"] != "Ashburn" {
+		t.Fatalf("second lookup: %d %s %v", status, state, body)
+	}
+	if calls := provider.calls.Load(); calls != 1 {
+		t.Errorf("provider called %d times, want 1", calls)
+	}
+}
+
+func TestServeCachedRemembersFailedLookups(t *testing.T) {
+	app, mr, _, provider := newTestApp(t)
+
+	// The fake provider knows nothing about 9.9.9.9
+	for _, want := range []string{CacheMiss, CacheHit} {
+		status, state, body := findIP(t, app, "9.9.9.9")
+		if status != fiber.StatusBadRequest || state != want || body["error"] != "invalid query" {
+			t.Fatalf("lookup: %d %s %v, want 400 %s", status, state, body, want)
+		}
+	}
+	if calls := provider.calls.Load(); calls != 1 {
+		t.Errorf("provider called %d times, want 1", calls)
+	}
+	if ttl := mr.TTL(negativeKey(geoIPKeyPrefix + "9.9.9.9")); ttl != 5*time.Minute {
+		t.Errorf("negative entry TTL = %v, want 5m", ttl)
+	}
+}
+
+func TestServeCachedRejectsNonPublicIPs(t *testing.T) {
+	app, _, _, provider := newTestApp(t)
+
+	status, _, body := findIP(t, app, "10.0.0.1")
+	if status != fiber.StatusBadRequest || body["error"] != errNonPublicIP.Error() {
+		t.Fatalf("lookup: %d %v", status, body)
+	}
+	if calls := provider.calls.Load(); calls != 0 {
+		t.Errorf("provider called %d times, want 0", calls)
+	}
+}
+
+func TestServeCachedRevalidatesStaleEntries(t *testing.T) {
+	app, mr, _, provider := newTestApp(t)
+	key := geoIPKeyPrefix + "1.1.1.1"
+
+	findIP(t, app, "1.1.1.1")
+
+	// Move into the stale window: less than StaleTTL of the entry is left
+	mr.FastForward(time.Hour + 30*time.Second)
+	status, state, body := findIP(t, app, "1.1.1.1")
+	if status != fiber.StatusOK || state != CacheStale || body["country"] != "Australia" {
+		t.Fatalf("stale lookup: %d %s %v", status, state, body)
+	}
+
+	// The background refresh fetches the entry again and resets its TTL
+	deadline := time.Now().Add(2 * time.Second)
+	for mr.TTL(key) <= time.Minute {
+		if time.Now().After(deadline) {
+			t.Fatal("stale entry was not refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if calls := provider.calls.Load(); calls != 2 {
+		t.Errorf("provider called %d times, want 2", calls)
+	}
+	if _, state, _ := findIP(t, app, "1.1.1.1"); state != CacheHit {
+		t.Errorf("after refresh: X-Cache = %s, want %s", state, CacheHit)
+	}
+}
+
+func TestGeoIPCacheIgnoresOtherSchemas(t *testing.T) {
+	_, mr, cache, _ := newTestApp(t)
+	key := geoIPKeyPrefix + "8.8.8.8"
+	mr.Set(key, "\x00\x00{}")
+
+	_, state, err := cache.Get(context.Background(), key)
+	if err != nil || state != CacheMiss {
+		t.Errorf("Get = %s, %v; want %s", state, err, CacheMiss)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// parseTrustedProxies parses a comma-separated list of CIDRs or bare IPs
+func parseTrustedProxies(s string) ([]netip.Prefix, error) {
+	prefixes := []netip.Prefix{}
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		if !strings.Contains(field, "/") {
+			addr, err := netip.ParseAddr(field)
+			if err != nil {
+				return nil, fmt.Errorf("trusted proxy %q: %w", field, err)
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q: %w", field, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func isTrustedProxy(addr netip.Addr, trustedProxies []netip.Prefix) bool {
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP works out the caller's address. X-Forwarded-For and X-Real-IP are
+// only believed when the direct peer is a trusted proxy; X-Forwarded-For is
+// walked right to left and the first hop that is not a trusted proxy wins.
+func clientIP(c *fiber.Ctx, trustedProxies []netip.Prefix) (netip.Addr, error) {
+	peer, err := netip.ParseAddr(c.IP())
+	if err != nil {
+		return netip.Addr{}, errInvalidIP
+	}
+	peer = peer.Unmap()
+	if !isTrustedProxy(peer, trustedProxies) {
+		return peer, nil
+	}
+
+	if forwarded := c.Get(fiber.HeaderXForwardedFor); forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				// A malformed hop cannot be trusted, so neither can anything to its left
+				return netip.Addr{}, errInvalidIP
+			}
+			hop = hop.Unmap()
+			if !isTrustedProxy(hop, trustedProxies) || i == 0 {
+				return hop, nil
+			}
+		}
+	}
+
+	if realIP := c.Get("X-Real-IP"); realIP != "" {
+		addr, err := netip.ParseAddr(strings.TrimSpace(realIP))
+		if err != nil {
+			return netip.Addr{}, errInvalidIP
+		}
+		return addr.Unmap(), nil
+	}
+
+	return peer, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+func TestClientIP(t *testing.T) {
+	trustedProxies, err := parseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		peer    string
+		headers map[string]string
+		want    string
+		err     error
+	}{
+		{name: "direct", peer: "8.8.8.8", want: "8.8.8.8"},
+		{name: "untrusted peer", peer: "8.8.8.8", headers: map[string]string{"X-Forwarded-For": "1.1.1.1"}, want: "8.8.8.8"},
+		{name: "trusted peer", peer: "10.1.2.3", headers: map[string]string{"X-Forwarded-For": "1.1.1.1"}, want: "1.1.1.1"},
+		{name: "proxy chain", peer: "10.1.2.3", headers: map[string]string{"X-Forwarded-For": "9.9.9.9, 1.1.1.1, 192.168.1.1"}, want: "1.1.1.1"},
+		{name: "all hops trusted", peer: "10.1.2.3", headers: map[string]string{"X-Forwarded-For": "10.0.0.2, 10.0.0.1"}, want: "10.0.0.2"},
+		{name: "malformed hop", peer: "10.1.2.3", headers: map[string]string{"X-Forwarded-For": "1.1.1.1, bogus"}, err: errInvalidIP},
+		{name: "real ip", peer: "192.168.1.1", headers: map[string]string{"X-Real-IP": "::ffff:1.1.1.1"}, want: "1.1.1.1"},
+	}
+
+	app := fiber.New()
+	for _, tt := range tests {
+		fctx := &fasthttp.RequestCtx{}
+		req := &fasthttp.Request{}
+		for name, value := range tt.headers {
+			req.Header.Set(name, value)
+		}
+		fctx.Init(req, &net.TCPAddr{IP: net.ParseIP(tt.peer)}, nil)
+		c := app.AcquireCtx(fctx)
+
+		addr, err := clientIP(c, trustedProxies)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.err)
+		} else if err == nil && addr.String() != tt.want {
+			t.Errorf("%s: clientIP = %s, want %s", tt.name, addr, tt.want)
+		}
+		app.ReleaseCtx(c)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// flightCall is an in-flight or completed fetch shared by every caller of the same key
+type flightCall struct {
+	wg    sync.WaitGroup
+	value IPAddress
+	err   error
+}
+
+// flightGroup coalesces concurrent fetches of the same key inside this process
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+// Do runs fn once per key at a time; concurrent callers wait and share its result
+func (g *flightGroup) Do(key string, fn func() (IPAddress, error)) (IPAddress, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		call.wg.Wait()
+		return call.value, call.err
+	}
+	call := &flightCall{}
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	call.value, call.err = fn()
+	call.wg.Done()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+
+	return call.value, call.err
+}
+
+// Releases the lock only if it still holds our token
+var unlockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// Fetch loads key with fetch and stores the result in the cache.
+// Concurrent fetches of the same key share one upstream call, and when
+// LockTTL is set a Redis lock extends that guarantee across instances.
+func (gc *GeoIPCache) Fetch(ctx context.Context, key string, fetch func() (IPAddress, error)) (IPAddress, error) {
+	return gc.flights.Do(key, func() (IPAddress, error) {
+		if gc.LockTTL <= 0 {
+			return gc.fetchAndSet(ctx, key, fetch)
+		}
+		return gc.fetchLocked(ctx, key, fetch)
+	})
+}
+
+func (gc *GeoIPCache) fetchAndSet(ctx context.Context, key string, fetch func() (IPAddress, error)) (IPAddress, error) {
+	ipAddress, err := fetch()
+	if lookupErr, ok := isLookupError(err); ok {
+		if err := gc.SetNegative(ctx, key, lookupErr); err != nil {
+			return IPAddress{}, err
+		}
+		return IPAddress{}, lookupErr
+	}
+	if err != nil {
+		return IPAddress{}, err
+	}
+	if err := gc.Set(ctx, key, ipAddress); err != nil {
+		return IPAddress{}, err
+	}
+	return ipAddress, nil
+}
+
+// fetchLocked fetches key while holding the Redis lock, or waits for the
+// instance that holds it to publish the result
+func (gc *GeoIPCache) fetchLocked(ctx context.Context, key string, fetch func() (IPAddress, error)) (IPAddress, error) {
+	lockKey := "lock:" + key
+	token, err := newRandomToken()
+	if err != nil {
+		return IPAddress{}, err
+	}
+
+	deadline := time.Now().Add(gc.LockTTL)
+	for {
+		// SET NX PX: only one instance gets the lock, and it expires if that instance dies
+		acquired, err := gc.rdb.SetNX(ctx, lockKey, token, gc.LockTTL).Result()
+		if err != nil {
+			return IPAddress{}, err
+		}
+		if acquired {
+			defer unlockScript.Run(ctx, gc.rdb, []string{lockKey}, token)
+			return gc.fetchAndSet(ctx, key, fetch)
+		}
+
+		// Another instance is fetching; poll until it releases the lock
+		if err := sleepContext(ctx, gc.LockPoll); err != nil {
+			return IPAddress{}, err
+		}
+		exists, err := gc.rdb.Exists(ctx, lockKey).Result()
+		if err != nil {
+			return IPAddress{}, err
+		}
+		if exists == 0 {
+			value, state, err := gc.Get(ctx, key)
+			if err != nil {
+				return IPAddress{}, err
+			}
+			if state == CacheHit {
+				return value, nil
+			}
+		}
+
+		// Give up waiting and fetch ourselves if the holder takes too long
+		if time.Now().After(deadline) {
+			return gc.fetchAndSet(ctx, key, fetch)
+		}
+	}
+}
+
+func newRandomToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Cached values are laid out as [schema version][compression][payload].
+// Bump codecVersion whenever cachedIPAddress changes shape; entries written
+// with another version then decode as a miss and are fetched again.
+const codecVersion byte = 1
+
+// Compression applied to the payload of a cached value
+const (
+	CompressNone   byte = 0
+	CompressSnappy byte = 1
+	CompressZstd   byte = 2
+)
+
+var errCodecVersion = errors.New("cached value has an unknown schema version")
+
+// zstd encoders and decoders are expensive to build but safe to share
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// cachedIPAddress is the compact JSON form of a successful IPAddress lookup
+type cachedIPAddress struct {
+	Country     string  `json:"c,omitempty"`
+	CountryCode string  `json:"cc,omitempty"`
+	Region      string  `json:"r,omitempty"`
+	RegionName  string  `json:"rn,omitempty"`
+	City        string  `json:"ci,omitempty"`
+	Zip         string  `json:"z,omitempty"`
+	Lat         float64 `json:"la"`
+	Lon         float64 `json:"lo"`
+	Timezone    string  `json:"tz,omitempty"`
+	Isp         string  `json:"i,omitempty"`
+	Org         string  `json:"o,omitempty"`
+	As          string  `json:"a,omitempty"`
+	Query       string  `json:"q,omitempty"`
+}
+
+// Codec converts IPAddress records to and from cached values
+type Codec struct {
+	Compression byte // used when encoding; decoding follows each value's header
+}
+
+// parseCompression maps "none", "snappy" or "zstd" to its compression byte
+func parseCompression(name string) (byte, error) {
+	switch name {
+	case "", "none":
+		return CompressNone, nil
+	case "snappy":
+		return CompressSnappy, nil
+	case "zstd":
+		return CompressZstd, nil
+	default:
+		return 0, fmt.Errorf("unknown compression %q", name)
+	}
+}
+
+func (c Codec) Encode(ipAddress IPAddress) ([]byte, error) {
+	payload, err := json.Marshal(cachedIPAddress{
+		Country:     ipAddress.Country,
+		CountryCode: ipAddress.CountryCode,
+		Region:      ipAddress.Region,
+		RegionName:  ipAddress.RegionName,
+		City:        ipAddress.City,
+		Zip:         ipAddress.Zip,
+		Lat:         ipAddress.Lat,
+		Lon:         ipAddress.Lon,
+		Timezone:    ipAddress.Timezone,
+		Isp:         ipAddress.Isp,
+		Org:         ipAddress.Org,
+		As:          ipAddress.As,
+		Query:       ipAddress.Query,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	header := []byte{codecVersion, c.Compression}
+	switch c.Compression {
+	case CompressNone:
+		return append(header, payload...), nil
+	case CompressSnappy:
+		return append(header, snappy.Encode(nil, payload)...), nil
+	case CompressZstd:
+		return zstdEncoder.EncodeAll(payload, header), nil
+	default:
+		return nil, fmt.Errorf("unknown compression %d", c.Compression)
+	}
+}
+
+func (c Codec) Decode(value []byte) (IPAddress, error) {
+	if len(value) < 2 || value[0] != codecVersion {
+		return IPAddress{}, errCodecVersion
+	}
+
+	payload := value[2:]
+	var err error
+	switch value[1] {
+	case CompressNone:
+	case CompressSnappy:
+		payload, err = snappy.Decode(nil, payload)
+	case CompressZstd:
+		payload, err = zstdDecoder.DecodeAll(payload, nil)
+	default:
+		err = fmt.Errorf("unknown compression %d", value[1])
+	}
+	if err != nil {
+		return IPAddress{}, err
+	}
+
+	cached := cachedIPAddress{}
+	if err := json.Unmarshal(payload, &cached); err != nil {
+		return IPAddress{}, err
+	}
+	return IPAddress{
+		Status:      "success",
+		Country:     cached.Country,
+		CountryCode: cached.CountryCode,
+		Region:      cached.Region,
+		RegionName:  cached.RegionName,
+		City:        cached.City,
+		Zip:         cached.Zip,
+		Lat:         cached.Lat,
+		Lon:         cached.Lon,
+		Timezone:    cached.Timezone,
+		Isp:         cached.Isp,
+		Org:         cached.Org,
+		As:          cached.As,
+		Query:       cached.Query,
+	}, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	want := sampleIPAddresses["8.8.8.8"]
+	want.Status = "success"
+
+	for _, compression := range []byte{CompressNone, CompressSnappy, CompressZstd} {
+		codec := Codec{Compression: compression}
+		value, err := codec.Encode(want)
+		if err != nil {
+			t.Fatalf("compression %d: encode: %v", compression, err)
+		}
+		if value[0] != codecVersion || value[1] != compression {
+			t.Errorf("compression %d: header = %v", compression, value[:2])
+		}
+
+		// Decoding follows the header, whatever the codec is set to
+		got, err := Codec{}.Decode(value)
+		if err != nil {
+			t.Fatalf("compression %d: decode: %v", compression, err)
+		}
+		if got != want {
+			t.Errorf("compression %d: got %+v, want %+v", compression, got, want)
+		}
+	}
+}
+
+func TestCodecDecodeRejectsOtherVersions(t *testing.T) {
+	for _, value := range [][]byte{nil, {codecVersion}, {codecVersion + 1, CompressNone, '{', '}'}} {
+		if _, err := (Codec{}).Decode(value); !errors.Is(err, errCodecVersion) {
+			t.Errorf("Decode(%v) error = %v, want %v", value, err, errCodecVersion)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Geo index of every resolved IP, positioned at its looked-up location
+const geoIndexKey = "geoip:geo"
+
+// Redis GEO cannot index latitudes closer to the poles than this
+const maxGeoLatitude = 85.05112878
+
+// Half the earth's circumference; a search this wide covers the whole globe
+const maxGeoRadiusKm = 20037.5
+
+// geoLoginsKey holds the locations user has logged in from
+func geoLoginsKey(user string) string {
+	return "geoip:logins:" + user
+}
+
+// geoLoginsSeenKey scores each location in geoLoginsKey(user) by when it was last used
+func geoLoginsSeenKey(user string) string {
+	return "geoip:logins:" + user + ":seen"
+}
+
+// Locations remembered per user, and how long a user's locations outlive their last login
+const (
+	maxLoginLocations = 50
+	loginRetention    = 90 * 24 * time.Hour
+)
+
+// Adds the location ARGV[1..3] (lon, lat, name) to the geo set KEYS[1],
+// marks it used at ARGV[4] in KEYS[2], forgets the least recently used
+// locations beyond ARGV[5] and expires both keys after ARGV[6] ms
+var rememberLoginScript = redis.NewScript(`
+redis.call("GEOADD", KEYS[1], ARGV[1], ARGV[2], ARGV[3])
+redis.call("ZADD", KEYS[2], ARGV[4], ARGV[3])
+local old = redis.call("ZRANGE", KEYS[2], 0, -tonumber(ARGV[5]) - 1)
+if #old > 0 then
+	redis.call("ZREM", KEYS[1], unpack(old))
+	redis.call("ZREM", KEYS[2], unpack(old))
+end
+redis.call("PEXPIRE", KEYS[1], ARGV[6])
+redis.call("PEXPIRE", KEYS[2], ARGV[6])
+return #old
+`)
+
+// geoLocation is the GEOADD entry for a resolved IP, or nil if it has no usable position
+func geoLocation(ipAddress IPAddress) *redis.GeoLocation {
+	if ipAddress.Query == "" || math.Abs(ipAddress.Lat) > maxGeoLatitude {
+		return nil
+	}
+	return &redis.GeoLocation{Name: ipAddress.Query, Longitude: ipAddress.Lon, Latitude: ipAddress.Lat}
+}
+
+// queueGeoAdd adds ipAddress to the geo index as part of pipe
+func queueGeoAdd(ctx context.Context, pipe redis.Pipeliner, ipAddress IPAddress) {
+	if location := geoLocation(ipAddress); location != nil {
+		pipe.GeoAdd(ctx, geoIndexKey, location)
+	}
+}
+
+// resolveIP returns the lookup of ip through the cache, fetching it on a miss
+func resolveIP(ctx context.Context, cache *GeoIPCache, provider GeoIPProvider, ip string) (IPAddress, error) {
+	addr, err := parsePublicIP(ip)
+	if err != nil {
+		return IPAddress{}, err
+	}
+	key := geoIPKey(addr)
+
+	ipAddress, state, err := cache.Get(ctx, key)
+	if err != nil {
+		return IPAddress{}, err
+	}
+	if state == CacheStale {
+		cache.Revalidate(ctx, key, fetchFrom(ctx, provider, addr.String()))
+	}
+	if state != CacheMiss {
+		return ipAddress, nil
+	}
+	return cache.Fetch(ctx, key, fetchFrom(ctx, provider, addr.String()))
+}
+
+// Struct for one IP found by a geo search
+type NearbyIP struct {
+	IP         string  `json:"ip"`
+	DistanceKm float64 `json:"distance_km"`
+	Lat        float64 `json:"lat"`
+	Lon        float64 `json:"lon"`
+}
+
+// nearbyIPs lists the resolved IPs within radius_km of lat/lon, nearest first
+func nearbyIPs(c *fiber.Ctx, ctx context.Context, rdb *redis.Client) error {
+	lat, err := strconv.ParseFloat(c.Query("lat"), 64)
+	if err != nil || math.Abs(lat) > maxGeoLatitude {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid lat"})
+	}
+	lon, err := strconv.ParseFloat(c.Query("lon"), 64)
+	if err != nil || math.Abs(lon) > 180 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid lon"})
+	}
+	radius, err := strconv.ParseFloat(c.Query("radius_km", "100"), 64)
+	if err != nil || radius <= 0 || radius > maxGeoRadiusKm {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid radius_km"})
+	}
+	limit, err := strconv.Atoi(c.Query("limit", "50"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "limit must be between 1 and 1000"})
+	}
+
+	locations, err := rdb.GeoSearchLocation(ctx, geoIndexKey, &redis.GeoSearchLocationQuery{
+		GeoSearchQuery: redis.GeoSearchQuery{
+			Longitude:  lon,
+			Latitude:   lat,
+			Radius:     radius,
+			RadiusUnit: "km",
+			Sort:       "ASC",
+			Count:      limit,
+		},
+		WithCoord: true,
+		WithDist:  true,
+	}).Result()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	nearby := make([]NearbyIP, 0, len(locations))
+	for _, location := range locations {
+		nearby = append(nearby, NearbyIP{
+			IP:         location.Name,
+			DistanceKm: location.Dist,
+			Lat:        location.Latitude,
+			Lon:        location.Longitude,
+		})
+	}
+
+	return c.JSON(nearby)
+}
+
+// ipDistance returns the distance in km between the locations of two IPs
+func ipDistance(c *fiber.Ctx, ctx context.Context, cache *GeoIPCache, provider GeoIPProvider) error {
+	from, err := resolveIP(ctx, cache, provider, c.Query("from"))
+	if err != nil {
+		return lookupFailed(c, err)
+	}
+	to, err := resolveIP(ctx, cache, provider, c.Query("to"))
+	if err != nil {
+		return lookupFailed(c, err)
+	}
+
+	fromLocation, toLocation := geoLocation(from), geoLocation(to)
+	if fromLocation == nil || toLocation == nil {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"error": "IP has no usable location"})
+	}
+
+	// Make sure both members are indexed, then let Redis measure
+	pipe := cache.rdb.Pipeline()
+	pipe.GeoAdd(ctx, geoIndexKey, fromLocation, toLocation)
+	distCmd := pipe.GeoDist(ctx, geoIndexKey, fromLocation.Name, toLocation.Name, "km")
+	if _, err := pipe.Exec(ctx); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(fiber.Map{
+		"from":        fromLocation.Name,
+		"to":          toLocation.Name,
+		"distance_km": distCmd.Val(),
+	})
+}
+
+// Struct for a login to check against a user's usual locations
+type LoginCheck struct {
+	User string `json:"user"`
+	IP   string `json:"ip"`
+}
+
+// checkLogin flags a login whose location is further than maxDistanceKm from
+// every location the user logged in from before, then remembers it
+func checkLogin(c *fiber.Ctx, ctx context.Context, cache *GeoIPCache, provider GeoIPProvider, maxDistanceKm float64) error {
+	login := LoginCheck{}
+	if err := c.BodyParser(&login); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid input JSON"})
+	}
+	if login.User == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "User is required"})
+	}
+
+	ipAddress, err := resolveIP(ctx, cache, provider, login.IP)
+	if err != nil {
+		return lookupFailed(c, err)
+	}
+	location := geoLocation(ipAddress)
+	if location == nil {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"error": "IP has no usable location"})
+	}
+
+	// Find the closest known location to this login
+	key := geoLoginsKey(login.User)
+	nearest, err := cache.rdb.GeoSearchLocation(ctx, key, &redis.GeoSearchLocationQuery{
+		GeoSearchQuery: redis.GeoSearchQuery{
+			Longitude:  location.Longitude,
+			Latitude:   location.Latitude,
+			Radius:     maxGeoRadiusKm,
+			RadiusUnit: "km",
+			Sort:       "ASC",
+			Count:      1,
+		},
+		WithDist: true,
+	}).Result()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	keys := []string{key, geoLoginsSeenKey(login.User)}
+	args := []interface{}{location.Longitude, location.Latitude, location.Name, time.Now().UnixMilli(), maxLoginLocations, loginRetention.Milliseconds()}
+	if err := rememberLoginScript.Run(ctx, cache.rdb, keys, args...).Err(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// A user's first login has nothing to compare against
+	result := fiber.Map{"user": login.User, "ip": location.Name, "country": ipAddress.Country, "suspicious": false}
+	if len(nearest) > 0 {
+		result["nearest_km"] = nearest[0].Dist
+		result["suspicious"] = nearest[0].Dist > maxDistanceKm
+	}
+
+	return c.JSON(result)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"net/netip"
+	"strings"
+)
+
+// Prefix of every GeoIP cache key; bump the version when the key layout changes.
+// Changes to the value format are handled by the codec version byte instead.
+const geoIPKeyPrefix = "geoip:v1:"
+
+// geoIPKey is the cache key for a canonical address
+func geoIPKey(addr netip.Addr) string {
+	return geoIPKeyPrefix + addr.String()
+}
+
+var (
+	errInvalidIP   = errors.New("invalid IP address")
+	errNonPublicIP = errors.New("IP address is private or reserved")
+)
+
+// Special-purpose ranges (RFC 6890 and friends) that are neither private nor
+// loopback but still have no location worth looking up
+var reservedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("192.88.99.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("100::/64"),
+	netip.MustParsePrefix("2001::/23"),
+	netip.MustParsePrefix("2001:db8::/32"),
+}
+
+// parsePublicIP parses s into its canonical form and rejects anything
+// that is not a publicly routable unicast address
+func parsePublicIP(s string) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(strings.TrimSpace(s))
+	if err != nil || addr.Zone() != "" {
+		return netip.Addr{}, errInvalidIP
+	}
+
+	// "::ffff:1.1.1.1" and "1.1.1.1" are the same host
+	addr = addr.Unmap()
+
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return netip.Addr{}, errNonPublicIP
+	}
+	for _, prefix := range reservedPrefixes {
+		if prefix.Contains(addr) {
+			return netip.Addr{}, errNonPublicIP
+		}
+	}
+	return addr, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParsePublicIP(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		err  error
+	}{
+		{in: "8.8.8.8", want: "8.8.8.8"},
+		{in: " 1.1.1.1 ", want: "1.1.1.1"},
+		{in: "::ffff:1.1.1.1", want: "1.1.1.1"},
+		{in: "2606:4700:4700::1111", want: "2606:4700:4700::1111"},
+		{in: "", err: errInvalidIP},
+		{in: "8.8.8", err: errInvalidIP},
+		{in: "fe80::1%eth0", err: errInvalidIP},
+		{in: "10.0.0.1", err: errNonPublicIP},
+		{in: "127.0.0.1", err: errNonPublicIP},
+		{in: "100.64.0.1", err: errNonPublicIP},
+		{in: "203.0.113.10", err: errNonPublicIP},
+		{in: "2001:db8::1", err: errNonPublicIP},
+		{in: "224.0.0.1", err: errNonPublicIP},
+	}
+	for _, tt := range tests {
+		addr, err := parsePublicIP(tt.in)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("parsePublicIP(%q) error = %v, want %v", tt.in, err, tt.err)
+			continue
+		}
+		if err == nil && addr.String() != tt.want {
+			t.Errorf("parsePublicIP(%q) = %s, want %s", tt.in, addr, tt.want)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// localCache is a bounded in-process LRU of recent lookups, each kept for ttl.
+// A nil *localCache is a valid, always-empty cache.
+type localCache struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	order    *list.List // front is most recently used
+	entries  map[string]*list.Element
+}
+
+type localEntry struct {
+	key       string
+	ipAddress IPAddress
+	expiresAt time.Time
+}
+
+func newLocalCache(capacity int, ttl time.Duration) *localCache {
+	return &localCache{
+		capacity: capacity,
+		ttl:      ttl,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (lc *localCache) Get(key string) (IPAddress, bool) {
+	if lc == nil {
+		return IPAddress{}, false
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	elem, ok := lc.entries[key]
+	if !ok {
+		return IPAddress{}, false
+	}
+	entry := elem.Value.(*localEntry)
+	if time.Now().After(entry.expiresAt) {
+		lc.order.Remove(elem)
+		delete(lc.entries, key)
+		return IPAddress{}, false
+	}
+	lc.order.MoveToFront(elem)
+	return entry.ipAddress, true
+}
+
+func (lc *localCache) Set(key string, ipAddress IPAddress) {
+	if lc == nil {
+		return
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	expiresAt := time.Now().Add(lc.ttl)
+	if elem, ok := lc.entries[key]; ok {
+		entry := elem.Value.(*localEntry)
+		entry.ipAddress = ipAddress
+		entry.expiresAt = expiresAt
+		lc.order.MoveToFront(elem)
+		return
+	}
+
+	lc.entries[key] = lc.order.PushFront(&localEntry{key: key, ipAddress: ipAddress, expiresAt: expiresAt})
+	// Evict the least recently used entry once over capacity
+	if lc.order.Len() > lc.capacity {
+		oldest := lc.order.Back()
+		lc.order.Remove(oldest)
+		delete(lc.entries, oldest.Value.(*localEntry).key)
+	}
+}
+
+func (lc *localCache) Delete(key string) {
+	if lc == nil {
+		return
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if elem, ok := lc.entries[key]; ok {
+		lc.order.Remove(elem)
+		delete(lc.entries, key)
+	}
+}
+
+// tierStats counts hits and misses of one cache tier
+type tierStats struct {
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+func (ts *tierStats) record(hit bool) {
+	if hit {
+		ts.hits.Add(1)
+	} else {
+		ts.misses.Add(1)
+	}
+}
+
+func (ts *tierStats) snapshot() map[string]int64 {
+	return map[string]int64{"hits": ts.hits.Load(), "misses": ts.misses.Load()}
+}
@@ -2,10 +2,13 @@ package main
 
 import (
 	"context"
-	"encoding/json"
-	"io"
+	"errors"
 	"log"
-	"net/http"
+	"math"
+	"net/netip"
+	"os"
+	"strconv"
+	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/gofiber/fiber/v2"
@@ -32,59 +35,194 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// Cache GeoIP answers for a fresh TTL, then serve them stale while refreshing
+	cache := NewGeoIPCache(rdb,
+		envDuration("GEOIP_FRESH_TTL", 24*time.Hour),
+		envDuration("GEOIP_STALE_TTL", time.Hour),
+	)
+	cache.NegativeTTL = envDuration("GEOIP_NEGATIVE_TTL", 5*time.Minute)
+	// Compress cached values with GEOIP_COMPRESSION=snappy or zstd
+	cache.Codec.Compression, err = parseCompression(os.Getenv("GEOIP_COMPRESSION"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Keep hot lookups in process memory too (disabled when GEOIP_LOCAL_SIZE is 0)
+	if size := envInt("GEOIP_LOCAL_SIZE", 10000); size > 0 {
+		if err := cache.EnableLocalCache(size, envDuration("GEOIP_LOCAL_TTL", 30*time.Second)); err != nil {
+			log.Fatal(err)
+		}
+		go cache.ListenInvalidations(ctx)
+	}
+	// Coalesce upstream fetches across instances with a Redis lock (disabled when 0)
+	cache.LockTTL = envDuration("GEOIP_LOCK_TTL", 0)
+
+	// Resolve addresses with ip-api.com unless GEOIP_PROVIDER selects another source
+	provider, err := providerFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if ipAPI, ok := provider.(*IPAPIProvider); ok {
+		ipAPI.Timeout = envDuration("GEOIP_UPSTREAM_TIMEOUT", 3*time.Second)
+		// ip-api allows 45 single lookups and 15 batch requests per minute across all our instances
+		if limit := envInt("GEOIP_RATE_LIMIT", 45); limit > 0 {
+			ipAPI.Limiter = NewRateLimiter(rdb, "geoip:ratelimit", limit, time.Minute, envInt("GEOIP_RATE_BURST", 5))
+		}
+		if limit := envInt("GEOIP_BATCH_RATE_LIMIT", 15); limit > 0 {
+			ipAPI.BatchLimiter = NewRateLimiter(rdb, "geoip:ratelimit:batch", limit, time.Minute, envInt("GEOIP_BATCH_RATE_BURST", 2))
+		}
+		// Stop calling ip-api for a while after repeated failures (disabled when 0)
+		if threshold := envInt("GEOIP_BREAKER_THRESHOLD", 5); threshold > 0 {
+			ipAPI.Breaker = NewCircuitBreaker(rdb, "geoip:breaker", threshold,
+				envDuration("GEOIP_BREAKER_WINDOW", 30*time.Second),
+				envDuration("GEOIP_BREAKER_OPEN", 30*time.Second),
+			)
+		}
+	}
+
+	// Refresh entries requested at least GEOIP_REFRESH_MIN_HITS times as soon as they turn stale
+	if minHits := envInt("GEOIP_REFRESH_MIN_HITS", 0); minHits > 0 {
+		go NewRefresher(cache, provider, float64(minHits)).Run(ctx)
+	}
+
+	// Forwarding headers are only trusted from these proxies
+	trustedProxies, err := parseTrustedProxies(os.Getenv("GEOIP_TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Count resolutions per country and ISP, keeping each day for GEOIP_STATS_RETENTION
+	stats := NewGeoStats(rdb, envDuration("GEOIP_STATS_RETENTION", 30*24*time.Hour))
+	go stats.Run(ctx, envDuration("GEOIP_STATS_FLUSH", 5*time.Second))
+
+	// Logins further than this from all of a user's earlier logins are flagged
+	loginMaxKm := envFloat("GEOIP_LOGIN_MAX_KM", 500)
+
 	// Define routes
-	app.Get("/myip", myIPCache1)
+	app.Get("/myip", func(c *fiber.Ctx) error {
+		return myIPCache1(c, ctx, provider)
+	})
 	app.Get("/myipcache2", func(c *fiber.Ctx) error {
-		return myIPCache2(c, ctx, rdb)
+		return myIPCache2(c, ctx, cache, provider, stats, trustedProxies)
+	})
+	app.Post("/findip", func(c *fiber.Ctx) error {
+		return findIP1(c, ctx, provider)
 	})
-	app.Post("/findip", findIP1)
 	app.Post("/findipcache2", func(c *fiber.Ctx) error {
-		return findIPCache2(c, ctx, rdb)
+		return findIPCache2(c, ctx, cache, provider, stats)
+	})
+	app.Post("/findip/batch", func(c *fiber.Ctx) error {
+		return findIPBatch(c, ctx, cache, provider, stats)
+	})
+	app.Get("/geo/nearby", func(c *fiber.Ctx) error {
+		return nearbyIPs(c, ctx, rdb)
+	})
+	app.Get("/geo/distance", func(c *fiber.Ctx) error {
+		return ipDistance(c, ctx, cache, provider)
+	})
+	app.Post("/geo/login-check", func(c *fiber.Ctx) error {
+		return checkLogin(c, ctx, cache, provider, loginMaxKm)
+	})
+	app.Get("/stats/geo", func(c *fiber.Ctx) error {
+		return topGeoStats(c, ctx, stats)
+	})
+
+	// Cache admin routes, protected by GEOIP_ADMIN_TOKEN
+	admin := app.Group("/admin/geoip", adminAuth(os.Getenv("GEOIP_ADMIN_TOKEN")))
+	admin.Get("/entries", func(c *fiber.Ctx) error {
+		return listCachedIPs(c, ctx, cache)
+	})
+	admin.Get("/entries/:ip", func(c *fiber.Ctx) error {
+		return getCachedIP(c, ctx, cache)
+	})
+	admin.Delete("/entries/:ip", func(c *fiber.Ctx) error {
+		return purgeCachedIP(c, ctx, cache)
+	})
+	admin.Delete("/entries", func(c *fiber.Ctx) error {
+		return purgeCachedRange(c, ctx, cache)
+	})
+	admin.Post("/warm", func(c *fiber.Ctx) error {
+		return warmCache(c, ctx, cache, provider)
+	})
+	admin.Get("/stats", func(c *fiber.Ctx) error {
+		return cacheStats(c, cache)
 	})
 
 	// Start Fiber server
 	log.Fatal(app.Listen(":3000"))
 }
 
-// Struct for GeoIP data
-type GeoIP struct {
-	IP string `json:"ip"`
+// envDuration reads a duration such as "30m" from the environment, falling back to def
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("invalid %s: %v", name, err)
+	}
+	return d
 }
 
-func myIPCache1(c *fiber.Ctx) error {
-	resp, err := http.Get("http://ip-api.com/json/")
+// envInt reads an integer from the environment, falling back to def
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
 	if err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "Failed to fetch IP information")
+		log.Fatalf("invalid %s: %v", name, err)
 	}
-	defer resp.Body.Close()
+	return n
+}
 
-	bodyBytes, err := io.ReadAll(resp.Body)
+// envFloat reads a number from the environment, falling back to def
+func envFloat(name string, def float64) float64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
 	if err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "Failed to read response body")
+		log.Fatalf("invalid %s: %v", name, err)
 	}
+	return f
+}
 
-	return c.Send(bodyBytes)
+// Struct for GeoIP data
+type GeoIP struct {
+	IP string `json:"ip"`
 }
 
-func findIP1(c *fiber.Ctx) error {
+func myIPCache1(c *fiber.Ctx, ctx context.Context, provider GeoIPProvider) error {
+	ipAddress, err := provider.Lookup(ctx, "")
+	if err != nil {
+		return lookupFailed(c, err)
+	}
+
+	return c.JSON(ipAddress)
+}
+
+func findIP1(c *fiber.Ctx, ctx context.Context, provider GeoIPProvider) error {
 	geoIP := GeoIP{}
 
 	if err := c.BodyParser(&geoIP); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid input JSON"})
 	}
 
-	resp, err := http.Get("http://ip-api.com/json/" + geoIP.IP)
+	addr, err := parsePublicIP(geoIP.IP)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch IP information"})
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 	}
-	defer resp.Body.Close()
 
-	bodyBytes, err := io.ReadAll(resp.Body)
+	ipAddress, err := provider.Lookup(ctx, addr.String())
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to read response body"})
+		return lookupFailed(c, err)
 	}
 
-	return c.Send(bodyBytes)
+	return c.JSON(ipAddress)
 }
 
 type IPAddress struct {
@@ -102,69 +240,98 @@ type IPAddress struct {
 	Org         string  `json:"org"`
 	As          string  `json:"as"`
 	Query       string  `json:"query"`
+	Message     string  `json:"message,omitempty"`
 }
 
-func myIPCache2(c *fiber.Ctx, ctx context.Context, rdb *redis.Client) error {
-	KEY_MYIP := "myIP"
-	ipAddress := IPAddress{}
-
-	cachedIP, err := rdb.Get(ctx, KEY_MYIP).Result()
-	if err != nil && err != redis.Nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to retrieve cached IP information"})
+// lookupFailed turns an invalid IP or a failed lookup into a 400, a spent rate limit into a 429,
+// an open circuit breaker into a 503 and any other upstream error into a 502
+func lookupFailed(c *fiber.Ctx, err error) error {
+	if errors.Is(err, errInvalidIP) || errors.Is(err, errNonPublicIP) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 	}
-
-	if cachedIP != "" {
-		if err := json.Unmarshal([]byte(cachedIP), &ipAddress); err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to unmarshal IP information"})
-		}
-		return c.JSON(ipAddress)
+	if lookupErr, ok := isLookupError(err); ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": lookupErr.Message})
+	}
+	if rateLimitErr, ok := isRateLimitError(err); ok {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(rateLimitErr.RetryAfter.Seconds()))))
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": "Upstream rate limit reached"})
 	}
+	if errors.Is(err, errCircuitOpen) {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "GeoIP upstream is unavailable"})
+	}
+	return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"error": "Failed to fetch IP information"})
+}
 
-	req := fiber.Post("http://ip-api.com/json/").Body(c.Body())
-	statusCode, body, _ := req.Bytes()
+// Cache key for the server's own public address, used when the caller has no public IP.
+// It shares the namespace of the per-IP keys so the admin API sees it as "self".
+const KEY_MYIP = geoIPKeyPrefix + "self"
 
-	if err := json.Unmarshal(body, &ipAddress); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to unmarshal IP information"})
+func myIPCache2(c *fiber.Ctx, ctx context.Context, cache *GeoIPCache, provider GeoIPProvider, stats *GeoStats, trustedProxies []netip.Prefix) error {
+	caller, err := clientIP(c, trustedProxies)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	if err := rdb.Set(ctx, KEY_MYIP, body, 0).Err(); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to cache IP information"})
+	// Callers on a private network share the server's egress address,
+	// so look that up instead of their unroutable one
+	addr, err := parsePublicIP(caller.String())
+	if err != nil {
+		return serveCached(c, ctx, cache, provider, stats, KEY_MYIP, "")
 	}
 
-	return c.Status(statusCode).JSON(ipAddress)
+	return serveCached(c, ctx, cache, provider, stats, geoIPKey(addr), addr.String())
 }
 
-func findIPCache2(c *fiber.Ctx, ctx context.Context, rdb *redis.Client) error {
+func findIPCache2(c *fiber.Ctx, ctx context.Context, cache *GeoIPCache, provider GeoIPProvider, stats *GeoStats) error {
 	geoIP := GeoIP{}
 
 	if err := c.BodyParser(&geoIP); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid input JSON"})
 	}
 
-	cachedIP, err := rdb.Get(ctx, geoIP.IP).Result()
-	if err != nil && err != redis.Nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to retrieve cached IP information"})
+	addr, err := parsePublicIP(geoIP.IP)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	ipAddress := IPAddress{}
+	return serveCached(c, ctx, cache, provider, stats, geoIPKey(addr), addr.String())
+}
 
-	if cachedIP != "" {
-		if err := json.Unmarshal([]byte(cachedIP), &ipAddress); err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to unmarshal cached IP information"})
+// serveCached answers with the cached lookup of ip stored under key,
+// fetching it from provider on a miss and refreshing it when stale.
+// Every successful answer is counted in stats.
+func serveCached(c *fiber.Ctx, ctx context.Context, cache *GeoIPCache, provider GeoIPProvider, stats *GeoStats, key, ip string) error {
+	ipAddress, state, err := cache.Get(ctx, key)
+	if _, ok := isLookupError(err); ok {
+		c.Set("X-Cache", state)
+		return lookupFailed(c, err)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to retrieve cached IP information"})
+	}
+
+	if state != CacheMiss {
+		if state == CacheStale {
+			cache.Revalidate(ctx, key, fetchFrom(ctx, provider, ip))
 		}
+		if ip != "" {
+			cache.RecordHit(key)
+		}
+		stats.Record(ipAddress)
+		c.Set("X-Cache", state)
 		return c.JSON(ipAddress)
 	}
 
-	req := fiber.Post("http://ip-api.com/json/" + geoIP.IP).Body(c.Body())
-	statusCode, body, _ := req.Bytes()
-
-	if err := json.Unmarshal(body, &ipAddress); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to unmarshal IP information from external API"})
+	ipAddress, err = cache.Fetch(ctx, key, fetchFrom(ctx, provider, ip))
+	if err != nil {
+		c.Set("X-Cache", CacheMiss)
+		return lookupFailed(c, err)
 	}
 
-	if err := rdb.Set(ctx, geoIP.IP, body, 0).Err(); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to cache IP information"})
+	if ip != "" {
+		cache.RecordHit(key)
 	}
-
-	return c.Status(statusCode).JSON(ipAddress)
+	stats.Record(ipAddress)
+	c.Set("X-Cache", CacheMiss)
+	return c.JSON(ipAddress)
 }
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// GeoIPProvider resolves an IP address to its location
+type GeoIPProvider interface {
+	// Lookup resolves ip, or the caller's own address when ip is empty.
+	// Addresses the provider cannot resolve are reported as *LookupError.
+	Lookup(ctx context.Context, ip string) (IPAddress, error)
+}
+
+// LookupError is a lookup the provider answered but could not resolve, e.g. a private or invalid IP
+type LookupError struct {
+	Message string
+}
+
+func (e *LookupError) Error() string {
+	return "ip lookup failed: " + e.Message
+}
+
+// isLookupError reports whether err is a failed lookup rather than an infrastructure error
+func isLookupError(err error) (*LookupError, bool) {
+	var lookupErr *LookupError
+	ok := errors.As(err, &lookupErr)
+	return lookupErr, ok
+}
+
+// BatchGeoIPProvider is a provider that can resolve many addresses in one call
+type BatchGeoIPProvider interface {
+	GeoIPProvider
+	// LookupBatch resolves ips in order, returning one result and one error per IP
+	LookupBatch(ctx context.Context, ips []string) ([]IPAddress, []error)
+}
+
+// IPAPIProvider looks addresses up with the ip-api.com JSON API
+type IPAPIProvider struct {
+	BaseURL      string // e.g. "http://ip-api.com/json/"; the IP is appended
+	BatchURL     string // e.g. "http://ip-api.com/batch"
+	Client       *http.Client
+	Timeout      time.Duration   // per request; 0 waits as long as ctx allows
+	Limiter      *RateLimiter    // optional budget every single lookup must fit in
+	BatchLimiter *RateLimiter    // optional budget of the batch endpoint, which ip-api limits separately
+	Breaker      *CircuitBreaker // optional breaker that stops calls while ip-api is down
+}
+
+// ip-api accepts at most this many IPs per batch request
+const ipAPIBatchLimit = 100
+
+func NewIPAPIProvider(baseURL, batchURL string) *IPAPIProvider {
+	return &IPAPIProvider{
+		BaseURL:  baseURL,
+		BatchURL: batchURL,
+		Client:   &http.Client{},
+		Timeout:  3 * time.Second,
+	}
+}
+
+func (p *IPAPIProvider) Lookup(ctx context.Context, ip string) (IPAddress, error) {
+	ipAddress := IPAddress{}
+
+	err := p.call(ctx, p.Limiter, func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.BaseURL+ip, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := p.Client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("ip-api returned status %d", resp.StatusCode)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&ipAddress); err != nil {
+			return fmt.Errorf("ip-api returned invalid JSON: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return ipAddress, err
+	}
+
+	// ip-api answers 200 even for failed lookups; the status field tells them apart
+	if ipAddress.Status != "success" {
+		return ipAddress, &LookupError{Message: ipAddress.Message}
+	}
+	return ipAddress, nil
+}
+
+func (p *IPAPIProvider) LookupBatch(ctx context.Context, ips []string) ([]IPAddress, []error) {
+	ipAddresses := make([]IPAddress, len(ips))
+	errs := make([]error, len(ips))
+
+	for start := 0; start < len(ips); start += ipAPIBatchLimit {
+		end := min(start+ipAPIBatchLimit, len(ips))
+		chunk, err := p.lookupChunk(ctx, ips[start:end])
+		for i := start; i < end; i++ {
+			switch {
+			case err != nil:
+				errs[i] = err
+			case chunk[i-start].Status != "success":
+				errs[i] = &LookupError{Message: chunk[i-start].Message}
+			default:
+				ipAddresses[i] = chunk[i-start]
+			}
+		}
+	}
+	return ipAddresses, errs
+}
+
+// lookupChunk sends one ip-api batch request of at most ipAPIBatchLimit IPs
+func (p *IPAPIProvider) lookupChunk(ctx context.Context, ips []string) ([]IPAddress, error) {
+	payload, err := json.Marshal(ips)
+	if err != nil {
+		return nil, err
+	}
+
+	var ipAddresses []IPAddress
+	err = p.call(ctx, p.BatchLimiter, func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.BatchURL, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := p.Client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("ip-api returned status %d", resp.StatusCode)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&ipAddresses); err != nil {
+			return fmt.Errorf("ip-api returned invalid JSON: %w", err)
+		}
+		if len(ipAddresses) != len(ips) {
+			return fmt.Errorf("ip-api returned %d results for %d IPs", len(ipAddresses), len(ips))
+		}
+		return nil
+	})
+	return ipAddresses, err
+}
+
+// call runs one upstream request through the rate limit, the circuit breaker
+// and the request timeout, reporting its outcome back to the breaker.
+// The limiter goes first: a half-open breaker hands out a single probe, and
+// a request the limiter then turned away would hold it without being sent.
+func (p *IPAPIProvider) call(ctx context.Context, limiter *RateLimiter, do func(ctx context.Context) error) error {
+	if limiter != nil {
+		if err := limiter.Take(ctx); err != nil {
+			return err
+		}
+	}
+	if p.Breaker != nil {
+		if err := p.Breaker.Allow(ctx); err != nil {
+			return err
+		}
+	}
+
+	reqCtx := ctx
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		reqCtx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+	err := do(reqCtx)
+
+	if p.Breaker != nil {
+		if recordErr := p.Breaker.Record(ctx, err == nil); recordErr != nil {
+			log.Printf("circuit breaker: %v", recordErr)
+		}
+	}
+	return err
+}
+
+// isRateLimitError reports whether err means the upstream budget is used up
+func isRateLimitError(err error) (*RateLimitError, bool) {
+	var rateLimitErr *RateLimitError
+	ok := errors.As(err, &rateLimitErr)
+	return rateLimitErr, ok
+}
+
+// lookupBatch resolves ips with a single call when provider supports batches,
+// and one lookup per IP otherwise
+func lookupBatch(ctx context.Context, provider GeoIPProvider, ips []string) ([]IPAddress, []error) {
+	if batcher, ok := provider.(BatchGeoIPProvider); ok {
+		return batcher.LookupBatch(ctx, ips)
+	}
+
+	ipAddresses := make([]IPAddress, len(ips))
+	errs := make([]error, len(ips))
+	for i, ip := range ips {
+		ipAddresses[i], errs[i] = provider.Lookup(ctx, ip)
+	}
+	return ipAddresses, errs
+}
+
+// providerFromEnv picks the provider named by GEOIP_PROVIDER: "ip-api" (default), "file" or "fake"
+func providerFromEnv() (GeoIPProvider, error) {
+	switch name := os.Getenv("GEOIP_PROVIDER"); name {
+	case "", "ip-api":
+		return NewIPAPIProvider("http://ip-api.com/json/", "http://ip-api.com/batch"), nil
+	case "file":
+		return LoadFileProvider(os.Getenv("GEOIP_DB"))
+	case "fake":
+		server := NewFakeIPAPIServer(sampleIPAddresses)
+		return NewIPAPIProvider(server.URL+"/json/", server.URL+"/batch"), nil
+	default:
+		return nil, fmt.Errorf("unknown GEOIP_PROVIDER %q", name)
+	}
+}
+
+// fetchFrom binds a lookup of ip to the fetch function the cache expects
+func fetchFrom(ctx context.Context, provider GeoIPProvider, ip string) func() (IPAddress, error) {
+	return func() (IPAddress, error) {
+		return provider.Lookup(ctx, ip)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Records served by the fake provider; the empty key answers "what is my IP"
+var sampleIPAddresses = map[string]IPAddress{
+	"": {
+		Country: "Thailand", CountryCode: "TH", Region: "10", RegionName: "Bangkok",
+		City: "Bangkok", Zip: "10200", Lat: 13.7563, Lon: 100.5018, Timezone: "Asia/Bangkok",
+		Isp: "Example ISP", Org: "Example Org", As: "AS64500 Example", Query: "203.0.113.10",
+	},
+	"1.1.1.1": {
+		Country: "Australia", CountryCode: "AU", Region: "QLD", RegionName: "Queensland",
+		City: "South Brisbane", Zip: "4101", Lat: -27.4766, Lon: 153.0166, Timezone: "Australia/Brisbane",
+		Isp: "Cloudflare, Inc", Org: "APNIC and Cloudflare DNS Resolver project", As: "AS13335 Cloudflare, Inc.", Query: "1.1.1.1",
+	},
+	"8.8.8.8": {
+		Country: "United States", CountryCode: "US", Region: "VA", RegionName: "Virginia",
+		City: "Ashburn", Zip: "20149", Lat: 39.03, Lon: -77.5, Timezone: "America/New_York",
+		Isp: "Google LLC", Org: "Google Public DNS", As: "AS15169 Google LLC", Query: "8.8.8.8",
+	},
+}
+
+// NewFakeIPAPIServer starts an in-process server that answers like ip-api.com/json/
+// from records, so the cache can be exercised without network access.
+// Point an IPAPIProvider at server.URL + "/json/".
+func NewFakeIPAPIServer(records map[string]IPAddress) *httptest.Server {
+	lookup := func(ip string) IPAddress {
+		ipAddress, ok := records[ip]
+		if !ok {
+			return IPAddress{Status: "fail", Message: "invalid query", Query: ip}
+		}
+		ipAddress.Status = "success"
+		return ipAddress
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/json/", func(w http.ResponseWriter, r *http.Request) {
+		ip := strings.TrimPrefix(r.URL.Path, "/json/")
+
+		w.Header().Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		_ = json.NewEncoder(w).Encode(lookup(ip))
+	})
+	mux.HandleFunc("/batch", func(w http.ResponseWriter, r *http.Request) {
+		var ips []string
+		if err := json.NewDecoder(r.Body).Decode(&ips); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ipAddresses := make([]IPAddress, len(ips))
+		for i, ip := range ips {
+			ipAddresses[i] = lookup(ip)
+		}
+
+		w.Header().Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		_ = json.NewEncoder(w).Encode(ipAddresses)
+	})
+	return httptest.NewServer(mux)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// FileProvider resolves addresses from a local MaxMind-style database.
+// The file is either a CSV whose header names a "network" column plus any
+// IPAddress JSON field names, or a JSON array of IPAddress objects that each
+// carry a "network" field.
+type FileProvider struct {
+	networks []fileNetwork
+}
+
+type fileNetwork struct {
+	prefix    netip.Prefix
+	ipAddress IPAddress
+}
+
+// LoadFileProvider reads the database at path; files ending in .csv are parsed as CSV, anything else as JSON
+func LoadFileProvider(path string) (*FileProvider, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		return readCSVDatabase(f)
+	}
+	return readJSONDatabase(f)
+}
+
+func readJSONDatabase(r io.Reader) (*FileProvider, error) {
+	var rows []struct {
+		Network string `json:"network"`
+		IPAddress
+	}
+	if err := json.NewDecoder(r).Decode(&rows); err != nil {
+		return nil, err
+	}
+
+	p := &FileProvider{}
+	for i, row := range rows {
+		prefix, err := netip.ParsePrefix(row.Network)
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %w", i+1, err)
+		}
+		p.networks = append(p.networks, fileNetwork{prefix: prefix.Masked(), ipAddress: row.IPAddress})
+	}
+	return p, nil
+}
+
+func readCSVDatabase(r io.Reader) (*FileProvider, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return &FileProvider{}, nil
+	}
+
+	header := records[0]
+	p := &FileProvider{}
+	for i, record := range records[1:] {
+		network := fileNetwork{}
+		for col, name := range header {
+			if name == "network" {
+				if network.prefix, err = netip.ParsePrefix(record[col]); err != nil {
+					return nil, fmt.Errorf("line %d: %w", i+2, err)
+				}
+				network.prefix = network.prefix.Masked()
+				continue
+			}
+			if err := setIPAddressField(&network.ipAddress, name, record[col]); err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+2, err)
+			}
+		}
+		p.networks = append(p.networks, network)
+	}
+	return p, nil
+}
+
+// setIPAddressField assigns value to the field whose JSON name is name; unknown columns are ignored
+func setIPAddressField(ipAddress *IPAddress, name, value string) error {
+	var err error
+	switch name {
+	case "country":
+		ipAddress.Country = value
+	case "countryCode":
+		ipAddress.CountryCode = value
+	case "region":
+		ipAddress.Region = value
+	case "regionName":
+		ipAddress.RegionName = value
+	case "city":
+		ipAddress.City = value
+	case "zip":
+		ipAddress.Zip = value
+	case "lat":
+		ipAddress.Lat, err = strconv.ParseFloat(value, 64)
+	case "lon":
+		ipAddress.Lon, err = strconv.ParseFloat(value, 64)
+	case "timezone":
+		ipAddress.Timezone = value
+	case "isp":
+		ipAddress.Isp = value
+	case "org":
+		ipAddress.Org = value
+	case "as":
+		ipAddress.As = value
+	}
+	if err != nil {
+		return fmt.Errorf("column %s: %w", name, err)
+	}
+	return nil
+}
+
+// Lookup returns the most specific network containing ip
+func (p *FileProvider) Lookup(ctx context.Context, ip string) (IPAddress, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return IPAddress{}, &LookupError{Message: "invalid query"}
+	}
+
+	var best *fileNetwork
+	for i := range p.networks {
+		network := &p.networks[i]
+		if network.prefix.Contains(addr) && (best == nil || network.prefix.Bits() > best.prefix.Bits()) {
+			best = network
+		}
+	}
+	if best == nil {
+		return IPAddress{}, &LookupError{Message: "not found"}
+	}
+
+	ipAddress := best.ipAddress
+	ipAddress.Status = "success"
+	ipAddress.Query = ip
+	return ipAddress, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func TestRateLimitedCallLeavesProbeFree(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	server := NewFakeIPAPIServer(sampleIPAddresses)
+	defer server.Close()
+
+	provider := NewIPAPIProvider(server.URL+"/json/", server.URL+"/batch")
+	provider.Limiter = NewRateLimiter(rdb, "test:ratelimit", 1, time.Minute, 1)
+	provider.Breaker = NewCircuitBreaker(rdb, "test:breaker", 1, time.Minute, time.Minute)
+
+	// Half-open: failures at the threshold but no open key
+	mr.Set("test:breaker:failures", "1")
+
+	ctx := context.Background()
+	if err := provider.Limiter.Take(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provider.Lookup(ctx, "8.8.8.8"); err == nil {
+		t.Fatal("lookup over the rate limit succeeded")
+	} else if _, ok := isRateLimitError(err); !ok {
+		t.Fatalf("lookup error = %v, want a rate limit error", err)
+	}
+	if mr.Exists("test:breaker:probe") {
+		t.Error("rate limited lookup took the half-open probe")
+	}
+}
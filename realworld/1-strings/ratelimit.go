@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// GCRA (generic cell rate algorithm) over a single Redis key holding the
+// theoretical arrival time (TAT) of the next request, in milliseconds.
+// Redis TIME is used as the clock so every instance agrees on "now".
+// ARGV[2] is the tolerance, how far ahead of now the TAT may run; it is
+// (burst-1) intervals. Returns 0 when the request is allowed, or how many
+// milliseconds to wait.
+var gcraScript = redis.NewScript(`
+redis.replicate_commands()
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local interval = tonumber(ARGV[1])
+local tolerance = tonumber(ARGV[2])
+
+local tat = tonumber(redis.call("GET", KEYS[1]) or now)
+if tat < now then
+	tat = now
+end
+
+local allowAt = tat - tolerance
+if allowAt > now then
+	return allowAt - now
+end
+
+local newTat = tat + interval
+redis.call("SET", KEYS[1], newTat, "PX", newTat - now)
+return 0
+`)
+
+// RateLimiter is a distributed rate limiter shared by every instance using the same key
+type RateLimiter struct {
+	rdb      *redis.Client
+	key      string
+	interval time.Duration // time between requests at the sustained rate
+	burst    int           // requests allowed back to back
+}
+
+// NewRateLimiter never lets more than limit requests through in any window
+// of period, at most burst of them back to back. The first burst requests
+// use part of the window's budget, so the rest are spread over the
+// remaining limit-burst+1 intervals.
+func NewRateLimiter(rdb *redis.Client, key string, limit int, period time.Duration, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	if burst > limit {
+		burst = limit
+	}
+	// The script counts whole milliseconds; round up, as a shorter interval
+	// would let more than limit requests through
+	interval := period / time.Duration(limit-burst+1)
+	if rounded := interval.Truncate(time.Millisecond); rounded < interval {
+		interval = rounded + time.Millisecond
+	}
+	return &RateLimiter{
+		rdb:      rdb,
+		key:      key,
+		interval: interval,
+		burst:    burst,
+	}
+}
+
+// RateLimitError means the shared upstream budget is used up for now
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("upstream rate limit reached, retry after %s", e.RetryAfter)
+}
+
+// Take uses one request from the budget, or returns a *RateLimitError saying when to retry
+func (rl *RateLimiter) Take(ctx context.Context) error {
+	interval := rl.interval.Milliseconds()
+	wait, err := gcraScript.Run(ctx, rl.rdb, []string{rl.key}, interval, interval*int64(rl.burst-1)).Int64()
+	if err != nil {
+		return err
+	}
+	if wait > 0 {
+		return &RateLimitError{RetryAfter: time.Duration(wait) * time.Millisecond}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func TestRateLimiterStaysWithinLimit(t *testing.T) {
+	tests := []struct {
+		limit, burst int
+	}{
+		{limit: 45, burst: 5},
+		{limit: 15, burst: 2},
+		{limit: 7, burst: 7},
+		{limit: 3, burst: 1},
+	}
+
+	for _, tt := range tests {
+		mr := miniredis.RunT(t)
+		rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		limiter := NewRateLimiter(rdb, "test:ratelimit", tt.limit, time.Minute, tt.burst)
+		ctx := context.Background()
+
+		// Ask as often as allowed for three windows, moving the server
+		// clock on by however long each refusal says to wait
+		start := time.Unix(1700000000, 0)
+		now := start
+		admits := []time.Time{}
+		for now.Before(start.Add(3 * time.Minute)) {
+			mr.SetTime(now)
+			err := limiter.Take(ctx)
+			if rateLimitErr, ok := isRateLimitError(err); ok {
+				now = now.Add(rateLimitErr.RetryAfter)
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			admits = append(admits, now)
+		}
+		rdb.Close()
+
+		// The first burst requests go through back to back
+		if len(admits) < tt.burst || !admits[tt.burst-1].Equal(start) {
+			t.Errorf("limit %d burst %d: first admits %v", tt.limit, tt.burst, admits[:min(len(admits), tt.burst)])
+		}
+		// No window of one minute starting at an admit holds more than limit
+		for i := range admits {
+			j := i
+			for j < len(admits) && admits[j].Sub(admits[i]) < time.Minute {
+				j++
+			}
+			if j-i > tt.limit {
+				t.Errorf("limit %d burst %d: %d admits in the minute from %s", tt.limit, tt.burst, j-i, admits[i].Sub(start))
+				break
+			}
+		}
+		// ...while the sustained rate still gets close to it
+		if len(admits) < tt.burst+3*(tt.limit-tt.burst+1)-2 {
+			t.Errorf("limit %d burst %d: only %d admits in three minutes", tt.limit, tt.burst, len(admits))
+		}
+	}
+}
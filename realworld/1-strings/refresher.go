@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Sorted set of cache keys scored by how often they were requested since their last refresh
+const popularityKey = "geoip:popularity"
+
+// refreshKey is the shadow key that expires when the entry under key turns stale
+func refreshKey(key string) string {
+	return "refresh:" + key
+}
+
+// RecordHit counts a request answered with the entry under key towards its
+// popularity. Failed lookups are not counted: negative entries have no
+// shadow key, so nothing would ever remove them from popularityKey.
+// Counts stay in process until the Refresher flushes them.
+func (gc *GeoIPCache) RecordHit(key string) {
+	if !gc.RefreshAhead {
+		return
+	}
+	gc.hitsMu.Lock()
+	defer gc.hitsMu.Unlock()
+	if gc.hits == nil {
+		gc.hits = map[string]float64{}
+	}
+	gc.hits[key]++
+}
+
+// flushHits adds the counted requests to popularityKey and trims it to its
+// maxTracked most popular keys, so entries purged or evicted before their
+// shadow key expired do not pile up. Unwritten counts are dropped.
+func (gc *GeoIPCache) flushHits(ctx context.Context, maxTracked int64) error {
+	gc.hitsMu.Lock()
+	hits := gc.hits
+	gc.hits = nil
+	gc.hitsMu.Unlock()
+	if len(hits) == 0 {
+		return nil
+	}
+
+	pipe := gc.rdb.Pipeline()
+	for key, count := range hits {
+		pipe.ZIncrBy(ctx, popularityKey, count, key)
+	}
+	pipe.ZRemRangeByRank(ctx, popularityKey, 0, -maxTracked-1)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// withKeyspaceFlags returns the notify-keyspace-events setting current with
+// the flags needed for expired keyevents added, or "" if it has them already
+func withKeyspaceFlags(current string) string {
+	flags := current
+	if !strings.Contains(flags, "E") {
+		flags += "E"
+	}
+	// "A" is an alias that includes "x"
+	if !strings.ContainsAny(flags, "xA") {
+		flags += "x"
+	}
+	if flags == current {
+		return ""
+	}
+	return flags
+}
+
+// Refresher re-fetches popular entries as soon as they turn stale, so
+// users keep getting hits instead of waiting on a miss after expiry.
+// It listens for the expired keyspace event of each entry's shadow key.
+type Refresher struct {
+	cache    *GeoIPCache
+	provider GeoIPProvider
+	MinHits  float64 // requests since the last refresh needed to count as popular
+
+	FlushInterval time.Duration // how often counted requests are written to Redis
+	MaxTracked    int64         // most keys popularityKey keeps counters for
+
+	// Refreshes run on Workers goroutines so slow upstream calls do not hold
+	// up the event loop. Up to QueueSize expired keys wait for a worker; more
+	// are dropped and refreshed on demand once they are requested stale.
+	Workers   int
+	QueueSize int
+}
+
+func NewRefresher(cache *GeoIPCache, provider GeoIPProvider, minHits float64) *Refresher {
+	cache.RefreshAhead = true
+	return &Refresher{
+		cache:         cache,
+		provider:      provider,
+		MinHits:       minHits,
+		FlushInterval: 5 * time.Second,
+		MaxTracked:    100000,
+		Workers:       4,
+		QueueSize:     1024,
+	}
+}
+
+// Run listens for expired shadow keys until ctx is done
+func (r *Refresher) Run(ctx context.Context) {
+	rdb := r.cache.rdb
+
+	// Expired events are off by default. Add them to whatever other
+	// consumers enabled; managed Redis may forbid CONFIG, in which case
+	// notify-keyspace-events has to include "Ex" already.
+	if err := r.enableExpiredEvents(ctx); err != nil {
+		log.Printf("refresher: enable keyspace events: %v", err)
+	}
+
+	channel := fmt.Sprintf("__keyevent@%d__:expired", rdb.Options().DB)
+	pubsub := rdb.Subscribe(ctx, channel)
+	defer pubsub.Close()
+	messages := pubsub.Channel()
+
+	flush := time.NewTicker(r.FlushInterval)
+	defer flush.Stop()
+
+	expired := make(chan string, r.QueueSize)
+	var workers sync.WaitGroup
+	for i := 0; i < r.Workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for key := range expired {
+				if err := r.refresh(ctx, key); err != nil {
+					log.Printf("refresher %s: %v", key, err)
+				}
+			}
+		}()
+	}
+	defer workers.Wait()
+	defer close(expired)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flush.C:
+			if err := r.cache.flushHits(ctx, r.MaxTracked); err != nil {
+				log.Printf("refresher: flush hits: %v", err)
+			}
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			key := strings.TrimPrefix(msg.Payload, refreshKey(""))
+			if key == msg.Payload || !strings.HasPrefix(key, geoIPKeyPrefix) {
+				continue
+			}
+			select {
+			case expired <- key:
+			default:
+				log.Printf("refresher %s: queue full, skipping refresh", key)
+			}
+		}
+	}
+}
+
+// enableExpiredEvents turns on expired keyevents without dropping other flags
+func (r *Refresher) enableExpiredEvents(ctx context.Context) error {
+	current, err := r.cache.rdb.ConfigGet(ctx, "notify-keyspace-events").Result()
+	if err != nil {
+		return err
+	}
+	value := ""
+	if len(current) == 2 {
+		value, _ = current[1].(string)
+	}
+	if flags := withKeyspaceFlags(value); flags != "" {
+		return r.cache.rdb.ConfigSet(ctx, "notify-keyspace-events", flags).Err()
+	}
+	return nil
+}
+
+// refresh re-fetches key if it was popular, resetting its counter either way
+func (r *Refresher) refresh(ctx context.Context, key string) error {
+	rdb := r.cache.rdb
+
+	hits, err := rdb.ZScore(ctx, popularityKey, key).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Every instance hears the event; whoever removes the counter does the refresh
+	removed, err := rdb.ZRem(ctx, popularityKey, key).Result()
+	if err != nil || removed == 0 || hits < r.MinHits {
+		return err
+	}
+
+	ip := strings.TrimPrefix(key, geoIPKeyPrefix)
+	_, err = r.cache.Fetch(ctx, key, fetchFrom(ctx, r.provider, ip))
+	if _, ok := isLookupError(err); ok {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func TestWithKeyspaceFlags(t *testing.T) {
+	tests := []struct {
+		current, want string
+	}{
+		{current: "", want: "Ex"},
+		{current: "Kg", want: "KgEx"},
+		{current: "Ex", want: ""},
+		{current: "xE", want: ""},
+		{current: "KA", want: "KAE"},
+		{current: "AKE", want: ""},
+	}
+	for _, tt := range tests {
+		if got := withKeyspaceFlags(tt.current); got != tt.want {
+			t.Errorf("withKeyspaceFlags(%q) = %q, want %q", tt.current, got, tt.want)
+		}
+	}
+}
+
+// blockingProvider holds every lookup until release is closed
+type blockingProvider struct {
+	release chan struct{}
+}
+
+func (p blockingProvider) Lookup(ctx context.Context, ip string) (IPAddress, error) {
+	<-p.release
+	return IPAddress{Status: "success", Query: ip}, nil
+}
+
+func TestRefresherKeepsFlushingDuringSlowRefreshes(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	provider := blockingProvider{release: make(chan struct{})}
+	defer close(provider.release)
+	cache := NewGeoIPCache(rdb, time.Hour, time.Minute)
+	refresher := NewRefresher(cache, provider, 1)
+	refresher.FlushInterval = 10 * time.Millisecond
+	refresher.Workers = 2
+
+	channel := "__keyevent@0__:expired"
+	go refresher.Run(ctx)
+	for rdb.PubSubNumSub(ctx, channel).Val()[channel] == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// More popular entries expire than there are workers, and every refresh hangs
+	for _, ip := range []string{"1.1.1.1", "8.8.8.8", "9.9.9.9", "8.8.4.4"} {
+		key := geoIPKeyPrefix + ip
+		mr.ZAdd(popularityKey, 5, key)
+		mr.Publish(channel, refreshKey(key))
+	}
+
+	// Hits still reach Redis
+	cache.RecordHit(geoIPKeyPrefix + "1.0.0.1")
+	deadline := time.Now().Add(time.Second)
+	for {
+		if score, err := mr.ZScore(popularityKey, geoIPKeyPrefix+"1.0.0.1"); err == nil && score == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("hits were not flushed while refreshes were running")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Layout of the ?day= parameter and of the day in stats keys
+const statsDayLayout = "2006-01-02"
+
+// Dimensions counted for every resolution, each a sorted set per day
+var statsDimensions = []string{"country", "isp", "as"}
+
+// GeoStats counts resolutions per country, ISP and AS for each UTC day.
+// Counts are kept in process and flushed to Redis every so often, so a
+// lookup served from the local tier still costs no Redis round trip.
+type GeoStats struct {
+	rdb       *redis.Client
+	Retention time.Duration // how long each day's counters are kept
+
+	mu      sync.Mutex
+	pending map[string]map[string]float64 // stats key -> member -> count not flushed yet
+}
+
+func NewGeoStats(rdb *redis.Client, retention time.Duration) *GeoStats {
+	return &GeoStats{rdb: rdb, Retention: retention, pending: map[string]map[string]float64{}}
+}
+
+// statsKey is the sorted set counting dimension on day
+func statsKey(day, dimension string) string {
+	return "geoip:stats:" + day + ":" + dimension
+}
+
+// Record counts each resolved address towards the next flush
+func (gs *GeoStats) Record(ipAddresses ...IPAddress) {
+	if len(ipAddresses) == 0 {
+		return
+	}
+	day := time.Now().UTC().Format(statsDayLayout)
+
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	for _, ipAddress := range ipAddresses {
+		members := []string{ipAddress.CountryCode, ipAddress.Isp, ipAddress.As}
+		for i, dimension := range statsDimensions {
+			if members[i] == "" {
+				continue
+			}
+			key := statsKey(day, dimension)
+			if gs.pending[key] == nil {
+				gs.pending[key] = map[string]float64{}
+			}
+			gs.pending[key][members[i]]++
+		}
+	}
+}
+
+// Flush adds the counts recorded since the last flush to Redis. Counts
+// that could not be written are kept for the next attempt.
+func (gs *GeoStats) Flush(ctx context.Context) error {
+	gs.mu.Lock()
+	pending := gs.pending
+	gs.pending = map[string]map[string]float64{}
+	gs.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	pipe := gs.rdb.Pipeline()
+	for key, counts := range pending {
+		for member, count := range counts {
+			pipe.ZIncrBy(ctx, key, count, member)
+		}
+		pipe.Expire(ctx, key, gs.Retention)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		gs.mu.Lock()
+		for key, counts := range pending {
+			if gs.pending[key] == nil {
+				gs.pending[key] = map[string]float64{}
+			}
+			for member, count := range counts {
+				gs.pending[key][member] += count
+			}
+		}
+		gs.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Run flushes every interval until ctx is done, then flushes once more
+func (gs *GeoStats) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := gs.Flush(context.Background()); err != nil {
+				log.Printf("flush stats: %v", err)
+			}
+			return
+		case <-ticker.C:
+			if err := gs.Flush(ctx); err != nil {
+				log.Printf("flush stats: %v", err)
+			}
+		}
+	}
+}
+
+// Struct for one ranked entry of the stats
+type StatsEntry struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+}
+
+// topGeoStats returns the top countries, ISPs and ASes of ?day= (today by
+// default), as of the last flush
+func topGeoStats(c *fiber.Ctx, ctx context.Context, stats *GeoStats) error {
+	day := c.Query("day", time.Now().UTC().Format(statsDayLayout))
+	if _, err := time.Parse(statsDayLayout, day); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "day must look like 2006-01-02"})
+	}
+	limit, err := strconv.Atoi(c.Query("limit", "10"))
+	if err != nil || limit <= 0 || limit > 100 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "limit must be between 1 and 100"})
+	}
+
+	pipe := stats.rdb.Pipeline()
+	cmds := make([]*redis.ZSliceCmd, len(statsDimensions))
+	for i, dimension := range statsDimensions {
+		cmds[i] = pipe.ZRevRangeWithScores(ctx, statsKey(day, dimension), 0, int64(limit-1))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	result := fiber.Map{"day": day}
+	for i, dimension := range statsDimensions {
+		entries := []StatsEntry{}
+		for _, z := range cmds[i].Val() {
+			entries = append(entries, StatsEntry{Name: z.Member.(string), Count: int64(z.Score)})
+		}
+		result[dimension] = entries
+	}
+
+	return c.JSON(result)
+}
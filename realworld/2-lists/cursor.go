@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Largest page findPosts will return
+const maxPageSize = 100
+
+// Prefix of every cursor, so the format can change without misreading old ones
+const cursorVersion = "v1:"
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// New post IDs are LPUSHed onto the head, so a post's distance from the
+// tail never changes when others are added. Trimming removes IDs from the
+// tail, so that distance is counted from the oldest post ever pushed by
+// adding the number trimmed so far (KEYS[2]). A cursor holds this offset
+// for the last ID a page read; the next page starts right after it.
+//
+// ARGV[1] is that offset, or "" to start at the head index ARGV[2].
+// Returns the number of posts ever pushed, the head index read from, up to
+// ARGV[3] IDs and the number of posts trimmed so far.
+var pageScript = redis.NewScript(`
+local trimmed = tonumber(redis.call("GET", KEYS[2]) or "0")
+local length = redis.call("LLEN", KEYS[1]) + trimmed
+local start = tonumber(ARGV[2])
+if ARGV[1] ~= "" then
+	start = length - tonumber(ARGV[1])
+end
+if start < 0 then
+	start = 0
+end
+return {length, start, redis.call("LRANGE", KEYS[1], start, start + tonumber(ARGV[3]) - 1), trimmed}
+`)
+
+// encodeCursor turns an offset into an opaque cursor
+func encodeCursor(offset int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(cursorVersion + strconv.FormatInt(offset, 10)))
+}
+
+// decodeCursor returns the offset held by cursor
+func decodeCursor(cursor string) (int64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || !strings.HasPrefix(string(raw), cursorVersion) {
+		return 0, errInvalidCursor
+	}
+	offset, err := strconv.ParseInt(strings.TrimPrefix(string(raw), cursorVersion), 10, 64)
+	if err != nil || offset < 0 {
+		return 0, errInvalidCursor
+	}
+	return offset, nil
+}
+
+// encodeStreamCursor turns a stream entry ID into an opaque cursor
+func encodeStreamCursor(id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(cursorVersion + id))
+}
+
+// decodeStreamCursor returns the stream entry ID held by cursor
+func decodeStreamCursor(cursor string) (string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || !strings.HasPrefix(string(raw), cursorVersion) {
+		return "", errInvalidCursor
+	}
+	id := strings.TrimPrefix(string(raw), cursorVersion)
+	if !streamIDPattern.MatchString(id) {
+		return "", errInvalidCursor
+	}
+	return id, nil
+}
+
+// toStrings converts the members of a Lua array reply
+func toStrings(values []interface{}) []string {
+	strs := make([]string, len(values))
+	for i, v := range values {
+		strs[i] = v.(string)
+	}
+	return strs
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	for _, offset := range []int64{0, 1, 42, 1 << 40} {
+		got, err := decodeCursor(encodeCursor(offset))
+		if err != nil || got != offset {
+			t.Errorf("decodeCursor(encodeCursor(%d)) = %d, %v", offset, got, err)
+		}
+	}
+}
+
+func TestDecodeCursorRejectsInvalid(t *testing.T) {
+	encode := func(s string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(s))
+	}
+	for _, cursor := range []string{
+		"",
+		"not base64!",
+		encode("42"),
+		encode("v2:42"),
+		encode(cursorVersion),
+		encode(cursorVersion + "abc"),
+		encode(cursorVersion + "-1"),
+	} {
+		if _, err := decodeCursor(cursor); !errors.Is(err, errInvalidCursor) {
+			t.Errorf("decodeCursor(%q) error = %v, want %v", cursor, err, errInvalidCursor)
+		}
+	}
+}
+
+func TestStreamCursorRoundTrip(t *testing.T) {
+	for _, id := range []string{"0-0", "1718000000000-3"} {
+		got, err := decodeStreamCursor(encodeStreamCursor(id))
+		if err != nil || got != id {
+			t.Errorf("decodeStreamCursor(encodeStreamCursor(%q)) = %q, %v", id, got, err)
+		}
+	}
+}
+
+func TestDecodeStreamCursorRejectsInvalid(t *testing.T) {
+	encode := func(s string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(s))
+	}
+	for _, cursor := range []string{
+		"1718000000000-3",
+		encode("1718000000000-3"),
+		encode(cursorVersion + "+"),
+		encode(cursorVersion + "1718000000000"),
+		encodeCursor(42),
+	} {
+		if _, err := decodeStreamCursor(cursor); !errors.Is(err, errInvalidCursor) {
+			t.Errorf("decodeStreamCursor(%q) error = %v, want %v", cursor, err, errInvalidCursor)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strconv"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Authors with more followers than this are not fanned out on write;
+// their followers merge in the author's own list when reading instead
+const fanoutThreshold = 10000
+
+// Set of authors whose posts are fanned out on read. Membership is kept
+// once gained, so an author's posts never come from both places unseen.
+const KEY_CELEBRITIES = "users:celebrities"
+
+// followersKey is the set of users following user
+func followersKey(user string) string {
+	return "followers:" + user
+}
+
+// followingKey is the set of users user follows
+func followingKey(user string) string {
+	return "following:" + user
+}
+
+// authorPostsKey lists the IDs of the posts written by user, newest first
+func authorPostsKey(user string) string {
+	return "posts:" + user
+}
+
+// timelineKey lists the IDs of the posts on user's home timeline, newest first
+func timelineKey(user string) string {
+	return "timeline:" + user
+}
+
+// Pushes ARGV[1] onto the head of list KEYS[1] and trims it to ARGV[2] IDs,
+// unless the list holds the ID already
+var pushOnceScript = redis.NewScript(`
+if redis.call("LPOS", KEYS[1], ARGV[1]) then
+	return 0
+end
+redis.call("LPUSH", KEYS[1], ARGV[1])
+redis.call("LTRIM", KEYS[1], 0, tonumber(ARGV[2]) - 1)
+return 1
+`)
+
+// queuePushCapped pushes id onto the head of list and trims it to the timeline
+// length. With once it skips lists that hold id already, which costs a scan
+// of the list, so only redeliveries use it.
+func queuePushCapped(ctx context.Context, pipe redis.Pipeliner, list, id string, once bool) {
+	if once {
+		// EVALSHA cannot fall back to EVAL inside a pipeline
+		pushOnceScript.Eval(ctx, pipe, []string{list}, id, maxTimelineLength)
+		return
+	}
+	pipe.LPush(ctx, list, id)
+	pipe.LTrim(ctx, list, 0, maxTimelineLength-1)
+}
+
+// fanOut pushes a new post onto its author's list, the author's own home
+// timeline and, unless the author has too many followers, every follower's.
+// A redelivery after a partial failure skips the lists that got the post.
+func fanOut(ctx context.Context, rdb *redis.Client, post Posts, redelivery bool) error {
+	if post.Author == "" {
+		return nil
+	}
+
+	pipe := rdb.Pipeline()
+	queuePushCapped(ctx, pipe, authorPostsKey(post.Author), post.ID, redelivery)
+	queuePushCapped(ctx, pipe, timelineKey(post.Author), post.ID, redelivery)
+	followers := pipe.SCard(ctx, followersKey(post.Author))
+	celebrity := pipe.SIsMember(ctx, KEY_CELEBRITIES, post.Author)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	// Followers of big accounts read the author's list directly
+	if celebrity.Val() || followers.Val() > fanoutThreshold {
+		return rdb.SAdd(ctx, KEY_CELEBRITIES, post.Author).Err()
+	}
+
+	members, err := rdb.SMembers(ctx, followersKey(post.Author)).Result()
+	if err != nil {
+		return err
+	}
+	pipe = rdb.Pipeline()
+	for _, follower := range members {
+		queuePushCapped(ctx, pipe, timelineKey(follower), post.ID, redelivery)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// Function to follow an author
+func followUser(c *fiber.Ctx, ctx context.Context, rdb *redis.Client) error {
+	user, author := c.Params("id"), c.Params("author")
+	if user == author {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Users cannot follow themselves"})
+	}
+
+	// Record the relation from both sides together
+	pipe := rdb.TxPipeline()
+	pipe.SAdd(ctx, followersKey(author), user)
+	pipe.SAdd(ctx, followingKey(user), author)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// Function to unfollow an author
+func unfollowUser(c *fiber.Ctx, ctx context.Context, rdb *redis.Client) error {
+	user, author := c.Params("id"), c.Params("author")
+
+	pipe := rdb.TxPipeline()
+	pipe.SRem(ctx, followersKey(author), user)
+	removed := pipe.SRem(ctx, followingKey(user), author)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	if removed.Val() == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Not following this user"})
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// Function to read a user's home timeline, newest first
+func findTimeline(c *fiber.Ctx, ctx context.Context, rdb *redis.Client) error {
+	user := c.Params("id")
+
+	// Retrieve count of posts from query parameters, default to 5 if not provided
+	count, err := strconv.Atoi(c.Query("count", "5"))
+	if err != nil || count <= 0 || count > maxPageSize {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "count must be between 1 and " + strconv.Itoa(maxPageSize)})
+	}
+
+	// Read the fanned out timeline and find the followed authors fanned out on read
+	pipe := rdb.Pipeline()
+	timeline := pipe.LRange(ctx, timelineKey(user), 0, int64(count-1))
+	celebrities := pipe.SInter(ctx, followingKey(user), KEY_CELEBRITIES)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// Merge in the newest posts of each of those authors
+	ids := timeline.Val()
+	if authors := celebrities.Val(); len(authors) > 0 {
+		pipe := rdb.Pipeline()
+		cmds := make([]*redis.StringSliceCmd, len(authors))
+		for i, author := range authors {
+			cmds[i] = pipe.LRange(ctx, authorPostsKey(author), 0, int64(count-1))
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		for _, cmd := range cmds {
+			ids = append(ids, cmd.Val()...)
+		}
+		ids = newestIDs(ids, count)
+	}
+
+	posts, err := loadPosts(ctx, rdb, ids)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(posts)
+}
+
+// newestIDs returns up to count distinct post IDs, newest first. IDs come
+// from an increasing counter, so a bigger ID is a newer post.
+func newestIDs(ids []string, count int) []string {
+	seen := map[string]bool{}
+	unique := []string{}
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+
+	sort.Slice(unique, func(i, j int) bool {
+		a, _ := strconv.ParseInt(unique[i], 10, 64)
+		b, _ := strconv.ParseInt(unique[j], 10, 64)
+		return a > b
+	})
+	if len(unique) > count {
+		unique = unique[:count]
+	}
+	return unique
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"a/queue"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestNewestIDs(t *testing.T) {
+	tests := []struct {
+		ids   []string
+		count int
+		want  []string
+	}{
+		{ids: nil, count: 10, want: []string{}},
+		{ids: []string{"3", "1", "2"}, count: 10, want: []string{"3", "2", "1"}},
+		{ids: []string{"5", "9", "5", "10", "9"}, count: 10, want: []string{"10", "9", "5"}},
+		{ids: []string{"1", "2", "3", "4"}, count: 2, want: []string{"4", "3"}},
+	}
+	for _, tt := range tests {
+		if got := newestIDs(tt.ids, tt.count); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("newestIDs(%v, %d) = %v, want %v", tt.ids, tt.count, got, tt.want)
+		}
+	}
+}
+
+func TestTimelineShowsArchivedPosts(t *testing.T) {
+	mr, rdb := newTestRedis(t)
+	ctx := context.Background()
+
+	app := fiber.New()
+	app.Put("/users/:id/following/:author", func(c *fiber.Ctx) error {
+		return followUser(c, ctx, rdb)
+	})
+	app.Get("/users/:id/timeline", func(c *fiber.Ctx) error {
+		return findTimeline(c, ctx, rdb)
+	})
+
+	if status := doJSON(t, app, http.MethodPut, "/users/bob/following/alice", "", nil); status != fiber.StatusOK {
+		t.Fatalf("follow: %d", status)
+	}
+	post := Posts{Author: "alice", Key: "hello", Value: "first post"}
+	if err := publishPost(ctx, rdb, &post); err != nil {
+		t.Fatal(err)
+	}
+
+	// Push alice's post off the site-wide list
+	for i := 0; i < maxTimelineLength; i++ {
+		other := Posts{Key: "other", Value: "unrelated"}
+		if err := publishPost(ctx, rdb, &other); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if mr.Exists(postKey(post.ID)) {
+		t.Fatal("post was not archived")
+	}
+
+	timeline := []Posts{}
+	if status := doJSON(t, app, http.MethodGet, "/users/bob/timeline", "", &timeline); status != fiber.StatusOK {
+		t.Fatalf("timeline: %d", status)
+	}
+	if !reflect.DeepEqual(timeline, []Posts{post}) {
+		t.Errorf("timeline = %+v, want %+v", timeline, []Posts{post})
+	}
+
+	// A post deleted before it was archived stays gone
+	deleted := Posts{Author: "alice", Key: "oops", Value: "deleted"}
+	if err := publishPost(ctx, rdb, &deleted); err != nil {
+		t.Fatal(err)
+	}
+	mr.Del(postKey(deleted.ID))
+	timeline = []Posts{}
+	doJSON(t, app, http.MethodGet, "/users/bob/timeline", "", &timeline)
+	if !reflect.DeepEqual(timeline, []Posts{post}) {
+		t.Errorf("after a delete: timeline = %+v, want %+v", timeline, []Posts{post})
+	}
+}
+
+func TestRetriedPublishFinishesDelivery(t *testing.T) {
+	mr, rdb := newTestRedis(t)
+	ctx := context.Background()
+	mr.SAdd(followersKey("alice"), "bob", "carol")
+
+	// The first attempt stored the post and reached only alice's own lists
+	post := Posts{ID: "7", Author: "alice", Key: "hello", Value: "scheduled"}
+	if _, err := storePost(ctx, rdb, post); err != nil {
+		t.Fatal(err)
+	}
+	mr.Lpush(authorPostsKey("alice"), post.ID)
+	mr.Lpush(timelineKey("alice"), post.ID)
+
+	// Retrying twice delivers the post to every list once and announces it once
+	for i := 0; i < 2; i++ {
+		retried := post
+		if err := publishPost(ctx, rdb, &retried); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, list := range []string{authorPostsKey("alice"), timelineKey("alice"), timelineKey("bob"), timelineKey("carol")} {
+		if ids, _ := mr.List(list); !reflect.DeepEqual(ids, []string{post.ID}) {
+			t.Errorf("%s = %v, want [%s]", list, ids, post.ID)
+		}
+	}
+	if events, _ := rdb.XLen(ctx, KEY_POSTS_EVENTS).Result(); events != 1 {
+		t.Errorf("post announced %d times, want once", events)
+	}
+}
+
+func TestRetriedPublishSkipsRecordedFanOut(t *testing.T) {
+	mr, rdb := newTestRedis(t)
+	ctx := context.Background()
+	mr.SAdd(followersKey("alice"), "bob")
+
+	// The first attempt fanned out, then failed before announcing; bob's
+	// timeline has been cleared since
+	post := Posts{Author: "alice", Key: "hello", Value: "scheduled"}
+	if err := publishPost(ctx, rdb, &post); err != nil {
+		t.Fatal(err)
+	}
+	mr.Del(timelineKey("bob"))
+	mr.Del(KEY_POSTS_EVENTS)
+	mr.HDel(deliveryKey(post.ID), "announced")
+
+	if err := publishPost(ctx, rdb, &post); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists(timelineKey("bob")) {
+		t.Error("retry fanned the post out again")
+	}
+	if events, _ := rdb.XLen(ctx, KEY_POSTS_EVENTS).Result(); events != 1 {
+		t.Errorf("post announced %d times, want once", events)
+	}
+}
+
+func TestCreatePostQueuesFailedDelivery(t *testing.T) {
+	mr, rdb := newTestRedis(t)
+	ctx := context.Background()
+	jobs := queue.New(rdb, jobsQueueName)
+
+	app := fiber.New()
+	app.Post("/posts", idempotent(ctx, rdb), func(c *fiber.Ctx) error {
+		return createPosts(c, ctx, rdb, jobs)
+	})
+
+	// Fanning out fails on a follower's timeline of the wrong type, after
+	// the post reached alice's own lists
+	mr.SAdd(followersKey("alice"), "bob")
+	mr.Set(timelineKey("bob"), "broken")
+
+	// A retry gets the same post back instead of creating another one
+	body := `{"author":"alice","key":"hello","value":"first post"}`
+	posts := make([]Posts, 2)
+	for i := range posts {
+		req := httptest.NewRequest(http.MethodPost, "/posts", strings.NewReader(body))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		req.Header.Set("Idempotency-Key", "k1")
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&posts[i])
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != fiber.StatusCreated {
+			t.Fatalf("request %d: %d, %v", i+1, resp.StatusCode, err)
+		}
+	}
+	post := posts[0]
+	if posts[1] != post {
+		t.Errorf("retry got %+v, want %+v", posts[1], post)
+	}
+	if ids, _ := mr.List(KEY_TESTER); !reflect.DeepEqual(ids, []string{post.ID}) {
+		t.Errorf("timeline = %v, want [%s]", ids, post.ID)
+	}
+
+	// The delivery was left to a job, which finishes it once fanning out works
+	ids, _ := mr.List("queue:" + jobsQueueName + ":ready")
+	if len(ids) != 1 {
+		t.Fatalf("queued jobs %v, want the redelivery", ids)
+	}
+	mr.Del(timelineKey("bob"))
+	payload := mr.HGet("queue:"+jobsQueueName+":jobs", ids[0])
+	if err := runJob(rdb)(ctx, queue.Job{ID: ids[0], Payload: payload}); err != nil {
+		t.Fatal(err)
+	}
+	for _, list := range []string{KEY_TESTER, authorPostsKey("alice"), timelineKey("alice"), timelineKey("bob")} {
+		if ids, _ := mr.List(list); !reflect.DeepEqual(ids, []string{post.ID}) {
+			t.Errorf("%s = %v, want [%s]", list, ids, post.ID)
+		}
+	}
+}
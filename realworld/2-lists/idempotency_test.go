@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/gofiber/fiber/v2"
+)
+
+// newIdempotentApp serves handler on POST /things behind idempotent
+func newIdempotentApp(t *testing.T, handler fiber.Handler) *fiber.App {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	app := fiber.New()
+	app.Post("/things", idempotent(context.Background(), rdb), handler)
+	return app
+}
+
+// postWithKey sends body to POST /things with the given Idempotency-Key and
+// returns the status code, the response body and whether it was replayed
+func postWithKey(t *testing.T, app *fiber.App, key, body string) (int, string, bool) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/things", strings.NewReader(body))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	req.Header.Set("Idempotency-Key", key)
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(data), resp.Header.Get("Idempotent-Replayed") == "true"
+}
+
+func TestIdempotentReplaysResponse(t *testing.T) {
+	runs := 0
+	app := newIdempotentApp(t, func(c *fiber.Ctx) error {
+		runs++
+		return c.Status(fiber.StatusCreated).JSON(fiber.Map{"run": runs})
+	})
+
+	status, body, replayed := postWithKey(t, app, "k1", `{"a":1}`)
+	if status != fiber.StatusCreated || replayed {
+		t.Fatalf("first request: %d %s, replayed %v", status, body, replayed)
+	}
+	again, againBody, replayed := postWithKey(t, app, "k1", `{"a":1}`)
+	if again != status || againBody != body || !replayed {
+		t.Errorf("retry: %d %s, replayed %v; want %d %s replayed", again, againBody, replayed, status, body)
+	}
+	if runs != 1 {
+		t.Errorf("handler ran %d times, want once", runs)
+	}
+
+	// Another key is another request
+	if status, _, replayed := postWithKey(t, app, "k2", `{"a":1}`); status != fiber.StatusCreated || replayed || runs != 2 {
+		t.Errorf("other key: %d, replayed %v, %d runs", status, replayed, runs)
+	}
+}
+
+func TestIdempotentRejectsDifferentBody(t *testing.T) {
+	app := newIdempotentApp(t, func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusCreated)
+	})
+
+	postWithKey(t, app, "k1", `{"a":1}`)
+	if status, body, _ := postWithKey(t, app, "k1", `{"a":2}`); status != fiber.StatusUnprocessableEntity {
+		t.Errorf("different body: %d %s, want 422", status, body)
+	}
+}
+
+func TestIdempotentConflictsWhileRunning(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	app := newIdempotentApp(t, func(c *fiber.Ctx) error {
+		close(started)
+		<-release
+		return c.SendStatus(fiber.StatusCreated)
+	})
+
+	done := make(chan int)
+	go func() {
+		status, _, _ := postWithKey(t, app, "k1", `{"a":1}`)
+		done <- status
+	}()
+	<-started
+
+	if status, body, _ := postWithKey(t, app, "k1", `{"a":1}`); status != fiber.StatusConflict {
+		t.Errorf("while running: %d %s, want 409", status, body)
+	}
+	close(release)
+	if status := <-done; status != fiber.StatusCreated {
+		t.Errorf("first request: %d, want 201", status)
+	}
+	if status, _, replayed := postWithKey(t, app, "k1", `{"a":1}`); status != fiber.StatusCreated || !replayed {
+		t.Errorf("after it finished: %d, replayed %v", status, replayed)
+	}
+}
+
+func TestIdempotentServerErrors(t *testing.T) {
+	runs := 0
+	app := newIdempotentApp(t, func(c *fiber.Ctx) error {
+		runs++
+		// Requests marked "applied" fail only after taking effect
+		if strings.Contains(string(c.Body()), "applied") {
+			markApplied(c)
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "boom"})
+	})
+
+	// A failure before taking effect runs again on retry
+	postWithKey(t, app, "k1", `{}`)
+	if status, _, replayed := postWithKey(t, app, "k1", `{}`); status != fiber.StatusInternalServerError || replayed || runs != 2 {
+		t.Errorf("unapplied retry: %d, replayed %v, %d runs", status, replayed, runs)
+	}
+
+	// One after taking effect is replayed
+	runs = 0
+	postWithKey(t, app, "k2", `{"applied":true}`)
+	if status, _, replayed := postWithKey(t, app, "k2", `{"applied":true}`); status != fiber.StatusInternalServerError || !replayed || runs != 1 {
+		t.Errorf("applied retry: %d, replayed %v, %d runs", status, replayed, runs)
+	}
+}
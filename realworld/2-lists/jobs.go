@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"a/queue"
+	"github.com/go-redis/redis/v8"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Name of the work queue served by this instance
+const jobsQueueName = "jobs"
+
+// Job type publishing a post at its scheduled time
+const jobPublishPost = "publish_post"
+
+// Struct for a job to enqueue, optionally not before RunAt
+type JobRequest struct {
+	Payload string     `json:"payload"`
+	RunAt   *time.Time `json:"run_at"`
+}
+
+// Struct for a job waiting in the scheduled set
+type ScheduledJob struct {
+	queue.Job
+	RunAt time.Time `json:"run_at"`
+}
+
+// Payload of the jobs the posts service queues for itself
+type PostJob struct {
+	Type string `json:"type"`
+	Post Posts  `json:"post"`
+}
+
+// runJob handles the jobs taken off the queue
+func runJob(rdb *redis.Client) queue.Handler {
+	return func(ctx context.Context, job queue.Job) error {
+		postJob := PostJob{}
+		if err := json.Unmarshal([]byte(job.Payload), &postJob); err == nil && postJob.Type == jobPublishPost {
+			if err := publishPost(ctx, rdb, &postJob.Post); err != nil {
+				return err
+			}
+			log.Printf("job %s: published post %s", job.ID, postJob.Post.ID)
+			return nil
+		}
+
+		log.Printf("job %s (attempt %d): %s", job.ID, job.Attempts+1, job.Payload)
+		return nil
+	}
+}
+
+// schedulePost queues post to be published at runAt. The ID is assigned
+// now and travels in the job, so a retried job cannot publish a second copy.
+func schedulePost(c *fiber.Ctx, ctx context.Context, rdb *redis.Client, jobs *queue.Queue, post Posts, runAt time.Time) error {
+	if err := assignPostID(ctx, rdb, &post); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	payload, err := json.Marshal(PostJob{Type: jobPublishPost, Post: post})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	job, err := jobs.Schedule(ctx, string(payload), runAt)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// The job ID can cancel or move the post until it is published
+	return c.Status(fiber.StatusAccepted).JSON(ScheduledJob{Job: job, RunAt: runAt})
+}
+
+// redeliverPost queues a job finishing the delivery of a stored post; the
+// job finds the post stored and redoes only the steps that did not complete
+func redeliverPost(ctx context.Context, jobs *queue.Queue, post Posts) error {
+	payload, err := json.Marshal(PostJob{Type: jobPublishPost, Post: post})
+	if err != nil {
+		return err
+	}
+	_, err = jobs.Enqueue(ctx, string(payload))
+	return err
+}
+
+// Function to add a job to the queue
+func enqueueJob(c *fiber.Ctx, ctx context.Context, jobs *queue.Queue) error {
+	request := JobRequest{}
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid input JSON"})
+	}
+	if request.Payload == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Payload is required"})
+	}
+
+	// Jobs due later wait in the scheduled set
+	if request.RunAt != nil && request.RunAt.After(time.Now()) {
+		job, err := jobs.Schedule(ctx, request.Payload, *request.RunAt)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.Status(fiber.StatusCreated).JSON(ScheduledJob{Job: job, RunAt: *request.RunAt})
+	}
+
+	job, err := jobs.Enqueue(ctx, request.Payload)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(job)
+}
+
+// Function to move a scheduled job to another time
+func rescheduleJob(c *fiber.Ctx, ctx context.Context, jobs *queue.Queue) error {
+	request := JobRequest{}
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid input JSON"})
+	}
+	if request.RunAt == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "run_at is required"})
+	}
+
+	moved, err := jobs.Reschedule(ctx, c.Params("id"), *request.RunAt)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	if !moved {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "No scheduled job with this ID"})
+	}
+
+	return c.JSON(fiber.Map{"id": c.Params("id"), "run_at": request.RunAt})
+}
+
+// Function to cancel a scheduled job
+func cancelJob(c *fiber.Ctx, ctx context.Context, jobs *queue.Queue) error {
+	cancelled, err := jobs.Cancel(ctx, c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	if !cancelled {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "No scheduled job with this ID"})
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// Function to report how many jobs are in each state
+func queueDepth(c *fiber.Ctx, ctx context.Context, jobs *queue.Queue) error {
+	depth, err := jobs.Depth(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(depth)
+}
+
+// Function to list the jobs that failed too often
+func deadJobs(c *fiber.Ctx, ctx context.Context, jobs *queue.Queue) error {
+	ids, err := jobs.Dead(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(ids)
+}
@@ -1,17 +1,38 @@
 package main
 
 import (
+	"a/queue"
 	"context"
-	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/go-redis/redis/v8"
 	"github.com/gofiber/fiber/v2"
 	"log"
+	"os"
 	"strconv"
+	"time"
 )
 
 func main() {
+	// Catch a typo in a validate tag now rather than on the first request
+	if err := checkValidateTags(&Posts{}); err != nil {
+		log.Fatal(err)
+	}
+
+	// Reject request bodies over POSTS_MAX_BODY_BYTES with 413. The default
+	// fits a post at its longest: 5000 characters written as \u escapes take
+	// up to 12 bytes each when they are surrogate pairs.
+	bodyLimit := 64 * 1024
+	if v := os.Getenv("POSTS_MAX_BODY_BYTES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			log.Fatalf("invalid POSTS_MAX_BODY_BYTES %q", v)
+		}
+		bodyLimit = n
+	}
+
 	// Initialize Fiber app
-	app := fiber.New()
+	app := fiber.New(fiber.Config{BodyLimit: bodyLimit, ErrorHandler: jsonErrorHandler})
 
 	// Initialize Redis client
 	rdb := redis.NewClient(&redis.Options{
@@ -30,115 +51,285 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// Work through queued jobs on this instance, promoting scheduled ones when due
+	// and requeueing those of workers that died
+	jobs := queue.New(rdb, jobsQueueName)
+	hostname, _ := os.Hostname()
+	go jobs.NewWorker(fmt.Sprintf("%s-%d", hostname, os.Getpid())).Run(ctx, runJob(rdb))
+	go jobs.RunReaper(ctx, jobs.HeartbeatTimeout)
+	go jobs.RunScheduler(ctx, time.Second)
+
+	// Relay new posts from one Redis subscription to every streaming client
+	broadcaster := NewPostBroadcaster(rdb)
+	go broadcaster.Run(ctx)
+
 	// Define routes
 	app.Get("/posts", func(c *fiber.Ctx) error {
 		return findPosts(c, ctx, rdb)
 	})
-	app.Post("/posts", func(c *fiber.Ctx) error {
-		return createPosts(c, ctx, rdb)
+	app.Post("/posts", idempotent(ctx, rdb), func(c *fiber.Ctx) error {
+		return createPosts(c, ctx, rdb, jobs)
+	})
+	app.Get("/posts/stream", func(c *fiber.Ctx) error {
+		return streamPostsSSE(c, ctx, rdb, broadcaster)
 	})
-	app.Delete("/posts", func(c *fiber.Ctx) error {
+	app.Get("/posts/ws", streamPostsWebSocket(ctx, rdb, broadcaster))
+	app.Get("/posts/search", func(c *fiber.Ctx) error {
+		return searchPosts(c, ctx, rdb)
+	})
+	app.Get("/posts/archive", func(c *fiber.Ctx) error {
+		return findArchivedPosts(c, ctx, rdb)
+	})
+	app.Get("/posts/:id", func(c *fiber.Ctx) error {
+		return findPost(c, ctx, rdb)
+	})
+	app.Put("/posts/:id", func(c *fiber.Ctx) error {
+		return updatePosts(c, ctx, rdb)
+	})
+	app.Delete("/posts/:id", func(c *fiber.Ctx) error {
 		return deletePosts(c, ctx, rdb)
 	})
+	app.Put("/users/:id/following/:author", func(c *fiber.Ctx) error {
+		return followUser(c, ctx, rdb)
+	})
+	app.Delete("/users/:id/following/:author", func(c *fiber.Ctx) error {
+		return unfollowUser(c, ctx, rdb)
+	})
+	app.Get("/users/:id/timeline", func(c *fiber.Ctx) error {
+		return findTimeline(c, ctx, rdb)
+	})
+	app.Post("/queue/jobs", func(c *fiber.Ctx) error {
+		return enqueueJob(c, ctx, jobs)
+	})
+	app.Get("/queue", func(c *fiber.Ctx) error {
+		return queueDepth(c, ctx, jobs)
+	})
+	app.Get("/queue/dead", func(c *fiber.Ctx) error {
+		return deadJobs(c, ctx, jobs)
+	})
+	app.Put("/queue/scheduled/:id", func(c *fiber.Ctx) error {
+		return rescheduleJob(c, ctx, jobs)
+	})
+	app.Delete("/queue/scheduled/:id", func(c *fiber.Ctx) error {
+		return cancelJob(c, ctx, jobs)
+	})
 
 	// Start Fiber server
 	log.Fatal(app.Listen(":3000"))
 }
 
 type Posts struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
+	ID     string `json:"id"`
+	Author string `json:"author,omitempty" redis:"author" validate:"trim,max=64,chars=name"`
+	Key    string `json:"key" redis:"key" validate:"trim,required,max=128,chars=slug"`
+	Value  string `json:"value" redis:"value" validate:"trim,required,max=5000,chars=text"`
+}
+
+// jsonErrorHandler answers errors no handler turned into a response, such as
+// an oversized body or an unknown route, in the same JSON shape as the handlers
+func jsonErrorHandler(c *fiber.Ctx, err error) error {
+	var fiberErr *fiber.Error
+	if errors.As(err, &fiberErr) {
+		return c.Status(fiberErr.Code).JSON(fiber.Map{"error": fiberErr.Message})
+	}
+	log.Printf("%s %s: %v", c.Method(), c.Path(), err)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Internal Server Error"})
+}
+
+// parsePost reads and validates the post in the request body, returning
+// the body of a 400 response when it is not acceptable
+func parsePost(c *fiber.Ctx, posts *Posts) fiber.Map {
+	// Parse the request body and store it in the posts struct.
+	if err := c.BodyParser(posts); err != nil {
+		return fiber.Map{"error": "Invalid input JSON"}
+	}
+
+	// List every field that breaks its rules at once.
+	if errs := validate(posts); len(errs) > 0 {
+		return fiber.Map{"error": "Invalid post", "fields": errs}
+	}
+	return nil
 }
 
 const KEY_TESTER = "KEY_TESTER"
 
+// Struct for one page of posts
+type PostsPage struct {
+	Posts      []Posts `json:"posts"`
+	NextCursor string  `json:"next_cursor,omitempty"`
+	HasMore    bool    `json:"has_more"`
+}
+
 // Function to find posts
 func findPosts(c *fiber.Ctx, ctx context.Context, rdb *redis.Client) error {
-	// Initialize variables to store a single post and an array of posts
-	post := Posts{}
+	// Initialize an array to store the posts of the page
 	posts := []Posts{}
 
-	// Retrieve page number and count of posts per page from query parameters
-	page, _ := strconv.Atoi(c.Query("page", "1"))   // Convert page parameter to integer, default to 1 if not provided
-	count, _ := strconv.Atoi(c.Query("count", "5")) // Convert count parameter to integer, default to 5 if not provided
+	// Retrieve count of posts per page from query parameters, default to 5 if not provided
+	count, err := strconv.Atoi(c.Query("count", "5"))
+	if err != nil || count <= 0 || count > maxPageSize {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "count must be between 1 and " + strconv.Itoa(maxPageSize)})
+	}
 
-	// Calculate start and end indexes based on page and count
-	start := (int64(page) - 1) * int64(count) // Calculate start index
-	end := int64(page)*int64(count) - 1       // Calculate end index
+	// A cursor from a previous page continues right after its last post.
+	// Without one, start at the newest post, or at the offset of the legacy page parameter.
+	after := ""
+	var start int64
+	if cursor := c.Query("cursor"); cursor != "" {
+		offset, err := decodeCursor(cursor)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		after = strconv.FormatInt(offset, 10)
+	} else {
+		page, err := strconv.Atoi(c.Query("page", "1"))
+		if err != nil || page <= 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "page must be a positive number"})
+		}
+		start = int64(page-1) * int64(count)
+	}
 
-	// Retrieve posts from Redis database within the specified range
-	postJSON, err := rdb.LRange(ctx, KEY_TESTER, start, end).Result() // Retrieve posts from Redis
-	if err != nil {
-		// If there's an error, return an internal server error response
+	// Deleted posts leave their IDs in the list, so keep reading IDs until the page is full
+	var next, trimmed int64
+	for {
+		// Retrieve the IDs of the posts still needed from Redis
+		need := count - len(posts)
+		result, err := pageScript.Run(ctx, rdb, []string{KEY_TESTER, KEY_TRIMMED}, after, start, need).Slice()
+		if err != nil {
+			// If there's an error, return an internal server error response
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		length, first, ids := result[0].(int64), result[1].(int64), toStrings(result[2].([]interface{}))
+		trimmed = result[3].(int64)
+
+		// Load the posts behind those IDs
+		found, err := loadPosts(ctx, rdb, ids)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		posts = append(posts, found...)
+
+		// Offset of the last ID read; anything older is on later pages,
+		// unless it was trimmed off the list already
+		next = length - first - int64(len(ids))
+		if len(ids) < need || len(posts) == count || next <= trimmed {
+			break
+		}
+		after = strconv.FormatInt(next, 10)
+	}
+
+	// The next page starts after the last post of this one, counted from the tail
+	page := PostsPage{Posts: posts, HasMore: next > trimmed}
+	if page.HasMore {
+		page.NextCursor = encodeCursor(next)
+	}
+
+	// Return the page of posts as a JSON response
+	return c.JSON(page)
+}
+
+// Function to find a single post by its ID
+func findPost(c *fiber.Ctx, ctx context.Context, rdb *redis.Client) error {
+	// Read the hash of the post in one call
+	cmd := rdb.HGetAll(ctx, postKey(c.Params("id")))
+	if err := cmd.Err(); err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 	}
+	// An empty hash means there is no such post
+	if len(cmd.Val()) == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Post not found"})
+	}
 
-	// Iterate over retrieved values
-	for _, v := range postJSON {
-		// Unmarshal each post from JSON format into 'post' struct
-		if err := json.Unmarshal([]byte(v), &post); err != nil {
-			// If there's an error during unmarshaling, return the error
-			return err
-		}
-		// Append the unmarshaled post to the posts array
-		posts = append(posts, post)
+	// Copy the hash fields into the post
+	post := Posts{ID: c.Params("id")}
+	if err := cmd.Scan(&post); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	// Return the array of posts as a JSON response
-	return c.JSON(posts)
+	return c.JSON(post)
 }
 
-func createPosts(c *fiber.Ctx, ctx context.Context, rdb *redis.Client) error {
+func createPosts(c *fiber.Ctx, ctx context.Context, rdb *redis.Client, jobs *queue.Queue) error {
 	// Create an empty struct to store posts.
 	posts := Posts{}
 
-	// Parse the request body and store it in the posts struct.
-	if err := c.BodyParser(&posts); err != nil {
-		// Return an error response if the input JSON is invalid.
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Invalid input JSON"})
+	// Parse and validate the request body into the posts struct.
+	if invalid := parsePost(c, &posts); invalid != nil {
+		// Return a bad request response listing what is wrong with the input.
+		return c.Status(fiber.StatusBadRequest).JSON(invalid)
 	}
+	// The server assigns IDs; any ID sent by the client is ignored.
+	posts.ID = ""
 
-	// Convert the posts struct to JSON format.
-	data, err := json.Marshal(&posts)
+	// A post with a future publish_at is handed to the queue to be published then.
+	if publishAt := c.Query("publish_at"); publishAt != "" {
+		runAt, err := time.Parse(time.RFC3339, publishAt)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "publish_at must be an RFC 3339 time"})
+		}
+		if runAt.After(time.Now()) {
+			return schedulePost(c, ctx, rdb, jobs, posts, runAt)
+		}
+	}
+
+	// Store the post.
+	stored, err := writePost(ctx, rdb, &posts)
 	if err != nil {
-		// Return an error response if there is an error in JSON marshaling.
+		// Return an error response if there is an error in writing the post to Redis.
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 	}
-	if len(data) == 0 {
-		// Return an error response if the JSON data is empty.
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Empty JSON data"})
-	}
+	// The post exists from here on, so a retry with the same Idempotency-Key
+	// must get this response instead of creating the post a second time.
+	markApplied(c)
 
-	// Push the JSON data onto the left end of a Redis list with a specific key.
-	if err := rdb.LPush(ctx, KEY_TESTER, data).Err(); err != nil {
-		// Return an error response if there is an error in pushing data to Redis.
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	// Deliver the post to the timelines, leaving it to a job if that fails.
+	if err := deliverPost(ctx, rdb, posts, !stored); err != nil {
+		log.Printf("deliver post %s: %v; queueing a retry", posts.ID, err)
+		if err := redeliverPost(ctx, jobs, posts); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error(), "id": posts.ID})
+		}
 	}
 
-	// If successful, return a 201 Created status without any additional data.
-	return c.SendStatus(fiber.StatusCreated)
+	// If successful, return a 201 Created status with the stored post.
+	return c.Status(fiber.StatusCreated).JSON(posts)
 }
 
-func deletePosts(c *fiber.Ctx, ctx context.Context, rdb *redis.Client) error {
+func updatePosts(c *fiber.Ctx, ctx context.Context, rdb *redis.Client) error {
 	// Create an empty struct to store posts.
 	posts := Posts{}
 
-	// Parse the request body and store it in the posts struct.
-	if err := c.BodyParser(&posts); err != nil {
-		// Return an error response if the input JSON is invalid.
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Invalid input JSON"})
+	// Parse and validate the request body into the posts struct.
+	if invalid := parsePost(c, &posts); invalid != nil {
+		// Return a bad request response listing what is wrong with the input.
+		return c.Status(fiber.StatusBadRequest).JSON(invalid)
 	}
+	// The ID always comes from the URL.
+	posts.ID = c.Params("id")
 
-	// Convert the posts struct to JSON format.
-	data, err := json.Marshal(&posts)
+	// Overwrite the key and value of the post if it exists. The author
+	// cannot be changed, so read back the post as it is now stored.
+	stored, err := updatePost(ctx, rdb, posts)
+	// If there is no such post, return a 404 Not Found status.
+	if err == redis.Nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Post not found"})
+	}
 	if err != nil {
-		// Return an error response if there is an error in JSON marshaling.
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 	}
 
-	// Remove posts from the Redis list with the specified key.
-	// LRem is a Redis command used to remove elements from a list.
-	val, err := rdb.LRem(ctx, KEY_TESTER, 1, data).Result()
+	// Index the post under the words of its new value.
+	if err := indexPost(ctx, rdb, stored); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// If successful, return the updated post.
+	return c.JSON(stored)
+}
+
+func deletePosts(c *fiber.Ctx, ctx context.Context, rdb *redis.Client) error {
+	// Delete the hash of the post. Its ID stays in the list, where findPosts
+	// skips it; removing it would shift the positions cursors point at.
+	val, err := rdb.Del(ctx, postKey(c.Params("id"))).Result()
 	if err != nil {
 		// Return an error response if there is an error in deleting posts.
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
@@ -148,6 +339,11 @@ func deletePosts(c *fiber.Ctx, ctx context.Context, rdb *redis.Client) error {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "No posts found to delete"})
 	}
 
+	// Remove the post from the search index too.
+	if err := unindexPost(ctx, rdb, c.Params("id")); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
 	// If successful, return a 200 OK status without any additional data.
 	return c.SendStatus(fiber.StatusOK)
 }
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Counter handing out post IDs
+const KEY_POST_SEQ = "KEY_TESTER:seq"
+
+// postKey is the hash holding the post with the given ID
+func postKey(id string) string {
+	return "post:" + id
+}
+
+// How long the delivery steps of a post are remembered, long enough for a
+// failed job publishing it to be retried
+const deliveryTTL = 24 * time.Hour
+
+// deliveryKey is the hash recording which delivery steps of the post with the
+// given ID completed: "fanout" once it is on the timelines and "announced"
+// with its event ID once it was streamed
+func deliveryKey(id string) string {
+	return "delivery:" + id
+}
+
+// Only update a post that still exists, so an edit racing a delete cannot bring it back.
+// Returns the post as stored, or an empty array if there is none.
+var updatePostScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return {}
+end
+redis.call("HSET", KEYS[1], "key", ARGV[1], "value", ARGV[2])
+return redis.call("HGETALL", KEYS[1])
+`)
+
+// updatePost overwrites the key and value of the post with post.ID and
+// returns the whole post as stored, or redis.Nil if it does not exist
+func updatePost(ctx context.Context, rdb *redis.Client, post Posts) (Posts, error) {
+	fields, err := updatePostScript.Run(ctx, rdb, []string{postKey(post.ID)}, post.Key, post.Value).StringSlice()
+	if err != nil {
+		return Posts{}, err
+	}
+	if len(fields) == 0 {
+		return Posts{}, redis.Nil
+	}
+
+	hash := map[string]string{}
+	for i := 0; i+1 < len(fields); i += 2 {
+		hash[fields[i]] = fields[i+1]
+	}
+	stored := Posts{ID: post.ID}
+	if err := redis.NewStringStringMapResult(hash, nil).Scan(&stored); err != nil {
+		return Posts{}, err
+	}
+	return stored, nil
+}
+
+// loadPosts reads the posts with the given IDs in order, from their hashes or
+// the archive, skipping deleted ones
+func loadPosts(ctx context.Context, rdb *redis.Client, ids []string) ([]Posts, error) {
+	pipe := rdb.Pipeline()
+	cmds := make([]*redis.StringStringMapCmd, len(ids))
+	for i, id := range ids {
+		cmds[i] = pipe.HGetAll(ctx, postKey(id))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	// Home timelines and author lists keep IDs of posts that have since
+	// moved to the archive; read those back from there
+	missing := []string{}
+	for i, cmd := range cmds {
+		if len(cmd.Val()) == 0 {
+			missing = append(missing, ids[i])
+		}
+	}
+	archived := map[string]Posts{}
+	if len(missing) > 0 {
+		var err error
+		if archived, err = loadArchivedPosts(ctx, rdb, missing); err != nil {
+			return nil, err
+		}
+	}
+
+	posts := []Posts{}
+	for i, cmd := range cmds {
+		if len(cmd.Val()) == 0 {
+			// A deleted post leaves its ID behind in the list
+			if post, ok := archived[ids[i]]; ok {
+				posts = append(posts, post)
+			}
+			continue
+		}
+		post := Posts{ID: ids[i]}
+		if err := cmd.Scan(&post); err != nil {
+			return nil, err
+		}
+		posts = append(posts, post)
+	}
+	return posts, nil
+}
+
+// assignPostID gives post the next ID; any ID sent by the client is ignored
+func assignPostID(ctx context.Context, rdb *redis.Client, post *Posts) error {
+	id, err := rdb.Incr(ctx, KEY_POST_SEQ).Result()
+	if err != nil {
+		return err
+	}
+	post.ID = strconv.FormatInt(id, 10)
+	return nil
+}
+
+// publishPost stores post and delivers it to the timelines, assigning it
+// the next ID unless it already has one. A post with an ID that is already
+// stored is not stored again, but the delivery steps that did not complete
+// are redone, so a scheduled post whose job is retried after a partial
+// failure is published once and reaches every timeline.
+func publishPost(ctx context.Context, rdb *redis.Client, post *Posts) error {
+	stored, err := writePost(ctx, rdb, post)
+	if err != nil {
+		return err
+	}
+	return deliverPost(ctx, rdb, *post, !stored)
+}
+
+// writePost indexes and stores post, assigning it the next ID unless it
+// already has one. It reports false if a post with that ID was already stored.
+func writePost(ctx context.Context, rdb *redis.Client, post *Posts) (bool, error) {
+	if post.ID == "" {
+		if err := assignPostID(ctx, rdb, post); err != nil {
+			return false, err
+		}
+	}
+
+	// Make the post findable by the words of its value. Indexing replaces
+	// earlier entries, so a retry can run it again.
+	if err := indexPost(ctx, rdb, *post); err != nil {
+		return false, err
+	}
+
+	// Store the post in its own hash and push its ID onto the left end of the capped list
+	return storePost(ctx, rdb, *post)
+}
+
+// deliverPost fans a stored post out to the home timelines and announces it
+// to the clients streaming new posts, recording each step in deliveryKey. A
+// redelivery skips the steps recorded and redoes the others without pushing
+// the post twice onto any list.
+func deliverPost(ctx context.Context, rdb *redis.Client, post Posts, redelivery bool) error {
+	fannedOut := false
+	if redelivery {
+		var err error
+		if fannedOut, err = rdb.HExists(ctx, deliveryKey(post.ID), "fanout").Result(); err != nil {
+			return err
+		}
+	}
+
+	// Deliver the post to the home timelines of the author's followers
+	if !fannedOut {
+		if err := fanOut(ctx, rdb, post, redelivery); err != nil {
+			return err
+		}
+		pipe := rdb.TxPipeline()
+		pipe.HSet(ctx, deliveryKey(post.ID), "fanout", 1)
+		pipe.Expire(ctx, deliveryKey(post.ID), deliveryTTL)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+	}
+
+	// Push the post to the clients streaming new posts
+	announcePost(ctx, rdb, post)
+	return nil
+}
@@ -0,0 +1,108 @@
+// Package queue is a reliable work queue built on Redis lists.
+//
+// Producers LPUSH job IDs onto a ready list. Each worker BLMOVEs the next
+// ID into its own processing list, so a job is never only in the worker's
+// memory. Workers heartbeat into a sorted set; the reaper puts the jobs of
+// workers that stopped heartbeating back on the ready list, and jobs that
+// failed MaxAttempts times end up on a dead-letter list. Jobs can also be
+// scheduled for later in a sorted set scored by their run-at time.
+package queue
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Job is one unit of work
+type Job struct {
+	ID       string `json:"id"`
+	Payload  string `json:"payload"`
+	Attempts int    `json:"attempts"` // failed attempts so far
+}
+
+// Depth is how many jobs are in each state
+type Depth struct {
+	Scheduled  int64 `json:"scheduled"`
+	Ready      int64 `json:"ready"`
+	Processing int64 `json:"processing"`
+	Dead       int64 `json:"dead"`
+	Workers    int64 `json:"workers"`
+}
+
+// Queue is a named queue; every instance using the same name shares it
+type Queue struct {
+	rdb              *redis.Client
+	Name             string
+	MaxAttempts      int           // failures before a job moves to the dead-letter list
+	HeartbeatTimeout time.Duration // silence after which a worker counts as gone
+}
+
+func New(rdb *redis.Client, name string) *Queue {
+	return &Queue{
+		rdb:              rdb,
+		Name:             name,
+		MaxAttempts:      5,
+		HeartbeatTimeout: 30 * time.Second,
+	}
+}
+
+// key names one of the queue's Redis keys
+func (q *Queue) key(part string) string {
+	return "queue:" + q.Name + ":" + part
+}
+
+// processingKey is the list of jobs taken by worker
+func (q *Queue) processingKey(worker string) string {
+	return q.key("processing:" + worker)
+}
+
+// Enqueue stores payload as a new job and makes it ready
+func (q *Queue) Enqueue(ctx context.Context, payload string) (Job, error) {
+	seq, err := q.rdb.Incr(ctx, q.key("seq")).Result()
+	if err != nil {
+		return Job{}, err
+	}
+	job := Job{ID: strconv.FormatInt(seq, 10), Payload: payload}
+
+	pipe := q.rdb.TxPipeline()
+	pipe.HSet(ctx, q.key("jobs"), job.ID, job.Payload)
+	pipe.LPush(ctx, q.key("ready"), job.ID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return Job{}, err
+	}
+	return job, nil
+}
+
+// Depth counts the jobs in each state and the live workers
+func (q *Queue) Depth(ctx context.Context) (Depth, error) {
+	workers, err := q.rdb.ZRange(ctx, q.key("workers"), 0, -1).Result()
+	if err != nil {
+		return Depth{}, err
+	}
+
+	pipe := q.rdb.Pipeline()
+	scheduled := pipe.ZCard(ctx, q.key("scheduled"))
+	ready := pipe.LLen(ctx, q.key("ready"))
+	dead := pipe.LLen(ctx, q.key("dead"))
+	processing := make([]*redis.IntCmd, len(workers))
+	for i, worker := range workers {
+		processing[i] = pipe.LLen(ctx, q.processingKey(worker))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return Depth{}, err
+	}
+
+	depth := Depth{Scheduled: scheduled.Val(), Ready: ready.Val(), Dead: dead.Val(), Workers: int64(len(workers))}
+	for _, cmd := range processing {
+		depth.Processing += cmd.Val()
+	}
+	return depth, nil
+}
+
+// Dead returns the IDs on the dead-letter list, most recent first
+func (q *Queue) Dead(ctx context.Context) ([]string, error) {
+	return q.rdb.LRange(ctx, q.key("dead"), 0, -1).Result()
+}
@@ -0,0 +1,247 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func newTestQueue(t *testing.T) (*miniredis.Miniredis, *Queue) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	return mr, New(rdb, "test")
+}
+
+// take moves the next ready job to w's processing list like Run does, then processes it
+func take(t *testing.T, w *Worker, handle Handler) error {
+	t.Helper()
+	ctx := context.Background()
+	id, err := w.q.rdb.LMove(ctx, w.q.key("ready"), w.q.processingKey(w.ID), "RIGHT", "LEFT").Result()
+	if err != nil {
+		t.Fatalf("take: %v", err)
+	}
+	return w.process(ctx, id, handle)
+}
+
+func list(t *testing.T, mr *miniredis.Miniredis, key string) []string {
+	t.Helper()
+	if !mr.Exists(key) {
+		return nil
+	}
+	values, err := mr.List(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return values
+}
+
+var errJob = errors.New("job failed")
+
+func TestWorkerRunAcksJobs(t *testing.T) {
+	mr, q := newTestQueue(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	job, err := q.Enqueue(ctx, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan Job, 1)
+	w := q.NewWorker("w1")
+	w.Poll = 10 * time.Millisecond
+	go w.Run(ctx, func(ctx context.Context, job Job) error {
+		done <- job
+		return nil
+	})
+
+	select {
+	case got := <-done:
+		if got != job {
+			t.Errorf("handled %+v, want %+v", got, job)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("job was not handled")
+	}
+
+	// Acking removes every trace of the job
+	deadline := time.Now().Add(time.Second)
+	for mr.Exists(q.key("jobs")) || len(list(t, mr, q.processingKey("w1"))) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("job was not acked")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if mr.Exists(q.key("ready")) || mr.Exists(q.key("attempts")) {
+		t.Error("acked job left state behind")
+	}
+}
+
+func TestFailedJobIsRetried(t *testing.T) {
+	mr, q := newTestQueue(t)
+	ctx := context.Background()
+	job, _ := q.Enqueue(ctx, "flaky")
+	w := q.NewWorker("w1")
+
+	if err := take(t, w, func(context.Context, Job) error { return errJob }); !errors.Is(err, errJob) {
+		t.Fatalf("process = %v, want %v", err, errJob)
+	}
+	if ready := list(t, mr, q.key("ready")); len(ready) != 1 || ready[0] != job.ID {
+		t.Fatalf("ready = %v, want [%s]", ready, job.ID)
+	}
+	if processing := list(t, mr, q.processingKey("w1")); len(processing) != 0 {
+		t.Errorf("processing = %v, want empty", processing)
+	}
+
+	// The retry sees the failed attempt and succeeds
+	var retried Job
+	if err := take(t, w, func(_ context.Context, job Job) error { retried = job; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if retried.ID != job.ID || retried.Payload != "flaky" || retried.Attempts != 1 {
+		t.Errorf("retried %+v", retried)
+	}
+	if mr.Exists(q.key("attempts")) || mr.Exists(q.key("jobs")) {
+		t.Error("acked job left state behind")
+	}
+}
+
+func TestJobFailingMaxAttemptsIsDead(t *testing.T) {
+	mr, q := newTestQueue(t)
+	ctx := context.Background()
+	q.MaxAttempts = 3
+	job, _ := q.Enqueue(ctx, "broken")
+	w := q.NewWorker("w1")
+
+	for i := 0; i < q.MaxAttempts; i++ {
+		take(t, w, func(context.Context, Job) error { return errJob })
+	}
+	dead, err := q.Dead(ctx)
+	if err != nil || len(dead) != 1 || dead[0] != job.ID {
+		t.Fatalf("dead = %v, %v; want [%s]", dead, err, job.ID)
+	}
+	if mr.Exists(q.key("ready")) {
+		t.Errorf("ready = %v, want empty", list(t, mr, q.key("ready")))
+	}
+	// The payload is kept for inspection
+	if payload := mr.HGet(q.key("jobs"), job.ID); payload != "broken" {
+		t.Errorf("payload = %q", payload)
+	}
+}
+
+// stale registers a worker holding ids whose last heartbeat was age ago
+func stale(t *testing.T, q *Queue, worker string, age time.Duration, ids ...string) {
+	t.Helper()
+	ctx := context.Background()
+	pipe := q.rdb.Pipeline()
+	for _, id := range ids {
+		pipe.HSet(ctx, q.key("jobs"), id, "payload "+id)
+		pipe.LPush(ctx, q.processingKey(worker), id)
+	}
+	pipe.ZAdd(ctx, q.key("workers"), &redis.Z{Score: float64(time.Now().Add(-age).UnixMilli()), Member: worker})
+	if _, err := pipe.Exec(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReapRequeuesJobsOfStaleWorkers(t *testing.T) {
+	mr, q := newTestQueue(t)
+	ctx := context.Background()
+	q.MaxAttempts = 2
+	stale(t, q, "gone", 2*q.HeartbeatTimeout, "1", "2")
+	stale(t, q, "alive", 0, "3")
+	mr.HSet(q.key("attempts"), "2", "1")
+
+	reaped, err := q.Reap(ctx)
+	if err != nil || reaped != 2 {
+		t.Fatalf("Reap = %d, %v; want 2", reaped, err)
+	}
+	// Job 1 goes back to the front of the ready list; job 2 is out of attempts
+	if ready := list(t, mr, q.key("ready")); len(ready) != 1 || ready[0] != "1" {
+		t.Errorf("ready = %v, want [1]", ready)
+	}
+	if dead := list(t, mr, q.key("dead")); len(dead) != 1 || dead[0] != "2" {
+		t.Errorf("dead = %v, want [2]", dead)
+	}
+	if mr.Exists(q.processingKey("gone")) {
+		t.Error("stale worker still holds jobs")
+	}
+	if processing := list(t, mr, q.processingKey("alive")); len(processing) != 1 {
+		t.Errorf("live worker lost its jobs: %v", processing)
+	}
+
+	workers, _ := mr.ZMembers(q.key("workers"))
+	if len(workers) != 1 || workers[0] != "alive" {
+		t.Errorf("workers = %v, want [alive]", workers)
+	}
+}
+
+func TestReapSparesWorkerThatCameBack(t *testing.T) {
+	mr, q := newTestQueue(t)
+	ctx := context.Background()
+	stale(t, q, "w1", 2*q.HeartbeatTimeout, "1")
+
+	// Reap picked w1 with this cutoff, but w1 heartbeats before the script runs
+	cutoff := time.Now().Add(-q.HeartbeatTimeout).UnixMilli()
+	q.rdb.ZAdd(ctx, q.key("workers"), &redis.Z{Score: float64(time.Now().UnixMilli()), Member: "w1"})
+
+	keys := []string{q.processingKey("w1"), q.key("ready"), q.key("dead"), q.key("attempts"), q.key("workers")}
+	reaped, err := reapScript.Run(ctx, q.rdb, keys, "w1", cutoff, q.MaxAttempts).Int()
+	if err != nil || reaped != -1 {
+		t.Fatalf("reapScript = %d, %v; want -1", reaped, err)
+	}
+	if processing := list(t, mr, q.processingKey("w1")); len(processing) != 1 {
+		t.Errorf("returning worker lost its jobs: %v", processing)
+	}
+	if mr.Exists(q.key("attempts")) {
+		t.Error("returning worker's jobs were counted as failed")
+	}
+}
+
+func TestScheduledJobs(t *testing.T) {
+	mr, q := newTestQueue(t)
+	ctx := context.Background()
+
+	due, _ := q.Schedule(ctx, "due", time.Now().Add(-time.Second))
+	later, _ := q.Schedule(ctx, "later", time.Now().Add(time.Hour))
+	cancelled, _ := q.Schedule(ctx, "cancelled", time.Now().Add(time.Hour))
+
+	if ok, err := q.Cancel(ctx, cancelled.ID); err != nil || !ok {
+		t.Fatalf("Cancel = %v, %v", ok, err)
+	}
+	if mr.HGet(q.key("jobs"), cancelled.ID) != "" {
+		t.Error("cancelled job kept its payload")
+	}
+
+	promoted, err := q.Promote(ctx)
+	if err != nil || promoted != 1 {
+		t.Fatalf("Promote = %d, %v; want 1", promoted, err)
+	}
+	if ready := list(t, mr, q.key("ready")); len(ready) != 1 || ready[0] != due.ID {
+		t.Errorf("ready = %v, want [%s]", ready, due.ID)
+	}
+	// Promoted jobs can no longer be cancelled or moved
+	if ok, _ := q.Cancel(ctx, due.ID); ok {
+		t.Error("cancelled a promoted job")
+	}
+	if ok, _ := q.Reschedule(ctx, due.ID, time.Now()); ok {
+		t.Error("rescheduled a promoted job")
+	}
+
+	if ok, err := q.Reschedule(ctx, later.ID, time.Now().Add(-time.Second)); err != nil || !ok {
+		t.Fatalf("Reschedule = %v, %v", ok, err)
+	}
+	if promoted, _ := q.Promote(ctx); promoted != 1 {
+		t.Errorf("rescheduled job not promoted")
+	}
+
+	depth, err := q.Depth(ctx)
+	if err != nil || depth != (Depth{Ready: 2}) {
+		t.Errorf("Depth = %+v, %v", depth, err)
+	}
+}
@@ -0,0 +1,79 @@
+package queue
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Requeues every job of a worker whose heartbeat (KEYS[5]) is no newer
+// than ARGV[2], counting it as a failure like failScript does. Checking the
+// heartbeat here keeps a worker that just came back from losing its jobs.
+var reapScript = redis.NewScript(`
+local beat = redis.call("ZSCORE", KEYS[5], ARGV[1])
+if beat and tonumber(beat) > tonumber(ARGV[2]) then
+	return -1
+end
+local reaped = 0
+while true do
+	local id = redis.call("RPOP", KEYS[1])
+	if not id then
+		break
+	end
+	local attempts = redis.call("HINCRBY", KEYS[4], id, 1)
+	if attempts >= tonumber(ARGV[3]) then
+		redis.call("LPUSH", KEYS[3], id)
+	else
+		redis.call("RPUSH", KEYS[2], id)
+	end
+	reaped = reaped + 1
+end
+redis.call("ZREM", KEYS[5], ARGV[1])
+return reaped
+`)
+
+// Reap requeues the jobs of workers that stopped heartbeating and returns how many
+func (q *Queue) Reap(ctx context.Context) (int, error) {
+	cutoff := strconv.FormatInt(time.Now().Add(-q.HeartbeatTimeout).UnixMilli(), 10)
+	workers, err := q.rdb.ZRangeByScore(ctx, q.key("workers"), &redis.ZRangeBy{Min: "-inf", Max: cutoff}).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, worker := range workers {
+		keys := []string{q.processingKey(worker), q.key("ready"), q.key("dead"), q.key("attempts"), q.key("workers")}
+		reaped, err := reapScript.Run(ctx, q.rdb, keys, worker, cutoff, q.MaxAttempts).Int()
+		if err != nil {
+			return total, err
+		}
+		if reaped > 0 {
+			total += reaped
+		}
+	}
+	return total, nil
+}
+
+// RunReaper reaps every interval until ctx is done
+func (q *Queue) RunReaper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reaped, err := q.Reap(ctx)
+			if err != nil {
+				log.Printf("queue %s reaper: %v", q.Name, err)
+			}
+			if reaped > 0 {
+				log.Printf("queue %s reaper: requeued %d jobs", q.Name, reaped)
+			}
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package queue
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Jobs promoted per script run, so one run never blocks Redis for long
+const promoteBatch = 100
+
+// Moves up to ARGV[2] jobs due by ARGV[1] from the scheduled set onto the ready list
+var promoteScript = redis.NewScript(`
+local due = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, tonumber(ARGV[2]))
+for _, id in ipairs(due) do
+	redis.call("ZREM", KEYS[1], id)
+	redis.call("LPUSH", KEYS[2], id)
+end
+return #due
+`)
+
+// Drops a job that is still scheduled; once promoted it can no longer be cancelled
+var cancelScript = redis.NewScript(`
+if redis.call("ZREM", KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call("HDEL", KEYS[2], ARGV[1])
+return 1
+`)
+
+// Moves a job that is still scheduled to a new run-at time
+var rescheduleScript = redis.NewScript(`
+if not redis.call("ZSCORE", KEYS[1], ARGV[1]) then
+	return 0
+end
+redis.call("ZADD", KEYS[1], ARGV[2], ARGV[1])
+return 1
+`)
+
+// Schedule stores payload as a new job that becomes ready at runAt
+func (q *Queue) Schedule(ctx context.Context, payload string, runAt time.Time) (Job, error) {
+	seq, err := q.rdb.Incr(ctx, q.key("seq")).Result()
+	if err != nil {
+		return Job{}, err
+	}
+	job := Job{ID: strconv.FormatInt(seq, 10), Payload: payload}
+
+	pipe := q.rdb.TxPipeline()
+	pipe.HSet(ctx, q.key("jobs"), job.ID, job.Payload)
+	pipe.ZAdd(ctx, q.key("scheduled"), &redis.Z{Score: float64(runAt.UnixMilli()), Member: job.ID})
+	if _, err := pipe.Exec(ctx); err != nil {
+		return Job{}, err
+	}
+	return job, nil
+}
+
+// Cancel deletes a scheduled job, reporting false if it is not scheduled (anymore)
+func (q *Queue) Cancel(ctx context.Context, id string) (bool, error) {
+	cancelled, err := cancelScript.Run(ctx, q.rdb, []string{q.key("scheduled"), q.key("jobs")}, id).Int()
+	return cancelled == 1, err
+}
+
+// Reschedule moves a scheduled job to runAt, reporting false if it is not scheduled (anymore)
+func (q *Queue) Reschedule(ctx context.Context, id string, runAt time.Time) (bool, error) {
+	moved, err := rescheduleScript.Run(ctx, q.rdb, []string{q.key("scheduled")}, id, runAt.UnixMilli()).Int()
+	return moved == 1, err
+}
+
+// Promote makes every job due by now ready and returns how many
+func (q *Queue) Promote(ctx context.Context) (int, error) {
+	keys := []string{q.key("scheduled"), q.key("ready")}
+	total := 0
+	for {
+		promoted, err := promoteScript.Run(ctx, q.rdb, keys, time.Now().UnixMilli(), promoteBatch).Int()
+		total += promoted
+		if err != nil || promoted < promoteBatch {
+			return total, err
+		}
+	}
+}
+
+// RunScheduler promotes due jobs every interval until ctx is done
+func (q *Queue) RunScheduler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := q.Promote(ctx); err != nil {
+				log.Printf("queue %s scheduler: %v", q.Name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package queue
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Takes a failed job off the processing list and counts the failure, then
+// moves it to the dead-letter list once it reached ARGV[2] failures or back
+// on the ready list otherwise. Does nothing if the reaper took it already.
+var failScript = redis.NewScript(`
+if redis.call("LREM", KEYS[1], 1, ARGV[1]) == 0 then
+	return 0
+end
+local attempts = redis.call("HINCRBY", KEYS[4], ARGV[1], 1)
+if attempts >= tonumber(ARGV[2]) then
+	redis.call("LPUSH", KEYS[3], ARGV[1])
+else
+	redis.call("LPUSH", KEYS[2], ARGV[1])
+end
+return attempts
+`)
+
+// Handler processes one job; returning an error counts as a failed attempt
+type Handler func(ctx context.Context, job Job) error
+
+// Worker takes jobs off a queue one at a time
+type Worker struct {
+	q    *Queue
+	ID   string
+	Poll time.Duration // how long one BLMOVE blocks waiting for a job
+}
+
+// NewWorker returns a worker that must have an ID unique among the queue's live workers
+func (q *Queue) NewWorker(id string) *Worker {
+	return &Worker{q: q, ID: id, Poll: 5 * time.Second}
+}
+
+// Run processes jobs with handle until ctx is done
+func (w *Worker) Run(ctx context.Context, handle Handler) {
+	go w.heartbeat(ctx)
+
+	for ctx.Err() == nil {
+		id, err := w.q.rdb.BLMove(ctx, w.q.key("ready"), w.q.processingKey(w.ID), "RIGHT", "LEFT", w.Poll).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("queue %s worker %s: %v", w.q.Name, w.ID, err)
+				time.Sleep(time.Second)
+			}
+			continue
+		}
+		if err := w.process(ctx, id, handle); err != nil {
+			log.Printf("queue %s job %s: %v", w.q.Name, id, err)
+		}
+	}
+}
+
+// process runs one job already moved onto this worker's processing list
+func (w *Worker) process(ctx context.Context, id string, handle Handler) error {
+	q := w.q
+	pipe := q.rdb.Pipeline()
+	payload := pipe.HGet(ctx, q.key("jobs"), id)
+	attempts := pipe.HGet(ctx, q.key("attempts"), id)
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return err
+	}
+	if payload.Err() == redis.Nil {
+		// The job is gone; just drop its ID
+		return q.rdb.LRem(ctx, q.processingKey(w.ID), 1, id).Err()
+	}
+	failures, _ := strconv.Atoi(attempts.Val())
+
+	if err := handle(ctx, Job{ID: id, Payload: payload.Val(), Attempts: failures}); err != nil {
+		keys := []string{q.processingKey(w.ID), q.key("ready"), q.key("dead"), q.key("attempts")}
+		if ferr := failScript.Run(ctx, q.rdb, keys, id, q.MaxAttempts).Err(); ferr != nil {
+			return ferr
+		}
+		return err
+	}
+
+	// Done: forget the job entirely
+	pipe = q.rdb.TxPipeline()
+	pipe.LRem(ctx, q.processingKey(w.ID), 1, id)
+	pipe.HDel(ctx, q.key("jobs"), id)
+	pipe.HDel(ctx, q.key("attempts"), id)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// heartbeat tells the reaper this worker is alive until ctx is done
+func (w *Worker) heartbeat(ctx context.Context) {
+	ticker := time.NewTicker(w.q.HeartbeatTimeout / 3)
+	defer ticker.Stop()
+
+	for {
+		now := float64(time.Now().UnixMilli())
+		if err := w.q.rdb.ZAdd(ctx, w.q.key("workers"), &redis.Z{Score: now, Member: w.ID}).Err(); err != nil && ctx.Err() == nil {
+			log.Printf("queue %s worker %s heartbeat: %v", w.q.Name, w.ID, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Words too common to be worth indexing
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true,
+	"be": true, "but": true, "by": true, "for": true, "from": true, "has": true,
+	"have": true, "i": true, "in": true, "is": true, "it": true, "its": true,
+	"of": true, "on": true, "or": true, "that": true, "the": true, "this": true,
+	"to": true, "was": true, "were": true, "will": true, "with": true,
+}
+
+// Scratch key the search script combines term sets into; scripts run one at a time
+const KEY_SEARCH_SCRATCH = "search:scratch"
+
+// termKey is the sorted set of the IDs of posts containing term, scored by how often
+func termKey(term string) string {
+	return "search:term:" + term
+}
+
+// postTermsKey is the set of terms the post with the given ID is indexed under
+func postTermsKey(id string) string {
+	return "search:post:" + id
+}
+
+// Replaces the index entries of the post ARGV[1]. KEYS[1] is the set of
+// terms it is indexed under, which the caller read beforehand: ARGV[2] terms
+// follow in ARGV and their keys in KEYS[2..]. The term/count pairs after
+// them are the new entries, again with their keys next in KEYS. If the set
+// changed in the meantime nothing is written and -1 is returned.
+var indexScript = redis.NewScript(`
+local old = tonumber(ARGV[2])
+local expected = {}
+for i = 1, old do
+	expected[ARGV[2 + i]] = true
+end
+local current = redis.call("SMEMBERS", KEYS[1])
+if #current ~= old then
+	return -1
+end
+for _, term in ipairs(current) do
+	if not expected[term] then
+		return -1
+	end
+end
+
+for i = 1, old do
+	redis.call("ZREM", KEYS[1 + i], ARGV[1])
+end
+redis.call("DEL", KEYS[1])
+local k = 2 + old
+for i = 3 + old, #ARGV, 2 do
+	redis.call("ZADD", KEYS[k], ARGV[i + 1], ARGV[1])
+	redis.call("SADD", KEYS[1], ARGV[i])
+	k = k + 1
+end
+return 0
+`)
+
+// Combines the term sets KEYS[2..] with ZINTERSTORE or ZUNIONSTORE
+// (ARGV[1]), summing the counts, and returns the ARGV[2] best IDs with scores
+var searchScript = redis.NewScript(`
+local terms = {}
+for i = 2, #KEYS do
+	terms[#terms + 1] = KEYS[i]
+end
+redis.call(ARGV[1], KEYS[1], #terms, unpack(terms))
+local hits = redis.call("ZREVRANGE", KEYS[1], 0, tonumber(ARGV[2]) - 1, "WITHSCORES")
+redis.call("DEL", KEYS[1])
+return hits
+`)
+
+// tokenize splits text into lowercase terms, dropping stop words, and counts each term
+func tokenize(text string) map[string]int {
+	terms := map[string]int{}
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	for _, word := range words {
+		if !stopWords[word] {
+			terms[word]++
+		}
+	}
+	return terms
+}
+
+// Attempts reindexPost makes while other writers keep reindexing the same post
+const maxIndexAttempts = 5
+
+var errIndexBusy = errors.New("search index kept changing while indexing the post")
+
+// indexPost makes post findable by the terms of its value, replacing any earlier entries
+func indexPost(ctx context.Context, rdb *redis.Client, post Posts) error {
+	return reindexPost(ctx, rdb, post.ID, tokenize(post.Value))
+}
+
+// unindexPost removes the post with the given ID from the index
+func unindexPost(ctx context.Context, rdb *redis.Client, id string) error {
+	return reindexPost(ctx, rdb, id, nil)
+}
+
+// reindexPost replaces the terms the post with the given ID is indexed under with terms
+func reindexPost(ctx context.Context, rdb *redis.Client, id string, terms map[string]int) error {
+	for attempt := 0; attempt < maxIndexAttempts; attempt++ {
+		old, err := rdb.SMembers(ctx, postTermsKey(id)).Result()
+		if err != nil {
+			return err
+		}
+
+		keys := []string{postTermsKey(id)}
+		args := []interface{}{id, len(old)}
+		for _, term := range old {
+			keys = append(keys, termKey(term))
+			args = append(args, term)
+		}
+		for term, count := range terms {
+			keys = append(keys, termKey(term))
+			args = append(args, term, count)
+		}
+
+		indexed, err := indexScript.Run(ctx, rdb, keys, args...).Int()
+		if err != nil || indexed == 0 {
+			return err
+		}
+	}
+	return errIndexBusy
+}
+
+// Struct for one post found by a search
+type SearchResult struct {
+	Posts
+	Score float64 `json:"score"`
+}
+
+// Function to search posts by the words of their value, best match first
+func searchPosts(c *fiber.Ctx, ctx context.Context, rdb *redis.Client) error {
+	// Retrieve count of results from query parameters, default to 10 if not provided
+	count, err := strconv.Atoi(c.Query("count", "10"))
+	if err != nil || count <= 0 || count > maxPageSize {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "count must be between 1 and " + strconv.Itoa(maxPageSize)})
+	}
+
+	// By default a post must contain every term; mode=any accepts any of them
+	command := "ZINTERSTORE"
+	switch c.Query("mode", "all") {
+	case "all":
+	case "any":
+		command = "ZUNIONSTORE"
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "mode must be all or any"})
+	}
+
+	q := c.Query("q")
+	if strings.TrimSpace(q) == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "q is required"})
+	}
+	keys := []string{KEY_SEARCH_SCRATCH}
+	for term := range tokenize(q) {
+		keys = append(keys, termKey(term))
+	}
+
+	// A query made only of stop words matches nothing
+	results := []SearchResult{}
+	if len(keys) == 1 {
+		return c.JSON(results)
+	}
+
+	hits, err := searchScript.Run(ctx, rdb, keys, command, count).StringSlice()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// Hits alternate between IDs and scores
+	ids := []string{}
+	scores := map[string]float64{}
+	for i := 0; i+1 < len(hits); i += 2 {
+		ids = append(ids, hits[i])
+		scores[hits[i]], _ = strconv.ParseFloat(hits[i+1], 64)
+	}
+
+	posts, err := loadPosts(ctx, rdb, ids)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	for _, post := range posts {
+		results = append(results, SearchResult{Posts: post, Score: scores[post.ID]})
+	}
+
+	return c.JSON(results)
+}
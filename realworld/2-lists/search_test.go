@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text string
+		want map[string]int
+	}{
+		{text: "", want: map[string]int{}},
+		{text: "The cat and the hat", want: map[string]int{"cat": 1, "hat": 1}},
+		{text: "Redis, redis... REDIS!", want: map[string]int{"redis": 3}},
+		{text: "go-redis v8 on ubuntu22", want: map[string]int{"go": 1, "redis": 1, "v8": 1, "ubuntu22": 1}},
+		{text: "Café naïve café", want: map[string]int{"café": 2, "naïve": 1}},
+	}
+	for _, tt := range tests {
+		if got := tokenize(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("tokenize(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestReindexPost(t *testing.T) {
+	mr, rdb := newTestRedis(t)
+	ctx := context.Background()
+
+	if err := indexPost(ctx, rdb, Posts{ID: "1", Value: "red red fish"}); err != nil {
+		t.Fatal(err)
+	}
+	if score, _ := mr.ZScore(termKey("red"), "1"); score != 2 {
+		t.Errorf("red scored %v, want 2", score)
+	}
+
+	// Reindexing drops the terms the post no longer has
+	if err := indexPost(ctx, rdb, Posts{ID: "1", Value: "blue fish"}); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists(termKey("red")) || !mr.Exists(termKey("blue")) || !mr.Exists(termKey("fish")) {
+		t.Errorf("after reindexing: keys %v", mr.Keys())
+	}
+
+	if err := unindexPost(ctx, rdb, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if keys := mr.Keys(); len(keys) != 0 {
+		t.Errorf("after unindexing: keys %v", keys)
+	}
+}
+
+func TestIndexScriptRejectsStaleTerms(t *testing.T) {
+	mr, rdb := newTestRedis(t)
+	ctx := context.Background()
+	indexPost(ctx, rdb, Posts{ID: "1", Value: "red fish"})
+
+	// The caller read only "red", but the post is under "fish" too
+	keys := []string{postTermsKey("1"), termKey("red"), termKey("blue")}
+	indexed, err := indexScript.Run(ctx, rdb, keys, "1", 1, "red", "blue", 1).Int()
+	if err != nil || indexed != -1 {
+		t.Fatalf("indexScript = %d, %v; want -1", indexed, err)
+	}
+	if mr.Exists(termKey("blue")) || !mr.Exists(termKey("red")) {
+		t.Error("a stale call changed the index")
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+// Channel every new post is published on
+const KEY_POSTS_CHANNEL = "posts:new"
+
+// Stream recording the order posts were announced in, for clients resuming with Last-Event-ID
+const KEY_POSTS_EVENTS = "posts:events"
+
+// How often an idle stream is poked, which also notices clients that left
+const streamKeepalive = 15 * time.Second
+
+// Events a slow client may fall behind by before it is disconnected to resume later
+const streamClientBuffer = 64
+
+// Post IDs are assigned before posts are stored, so posts are not announced
+// in ID order. Each announcement therefore gets a stream entry whose ID
+// becomes the event ID; XADD and PUBLISH run together, so subscribers see
+// announcements in stream order. The message is "<event ID> <post JSON>".
+// The announcement is recorded in the post's delivery hash KEYS[2], and a
+// post announced already is not announced again.
+var announceScript = redis.NewScript(`
+if redis.call("HEXISTS", KEYS[2], "announced") == 1 then
+	return false
+end
+local eventID = redis.call("XADD", KEYS[1], "MAXLEN", "~", ARGV[1], "*", "post", ARGV[2])
+redis.call("PUBLISH", ARGV[3], eventID .. " " .. ARGV[4])
+redis.call("HSET", KEYS[2], "announced", eventID)
+redis.call("PEXPIRE", KEYS[2], ARGV[5])
+return eventID
+`)
+
+// Struct for one announced post as streamed to clients
+type PostEvent struct {
+	EventID string `json:"event_id"`
+	Post    Posts  `json:"post"`
+}
+
+// announcePost publishes a new post to the live streams. A failure is only
+// logged: the post is stored and shows up in GET /posts anyway.
+func announcePost(ctx context.Context, rdb *redis.Client, post Posts) {
+	data, err := json.Marshal(post)
+	if err == nil {
+		keys := []string{KEY_POSTS_EVENTS, deliveryKey(post.ID)}
+		err = announceScript.Run(ctx, rdb, keys, maxTimelineLength, post.ID, KEY_POSTS_CHANNEL, data, deliveryTTL.Milliseconds()).Err()
+	}
+	if err != nil && err != redis.Nil {
+		log.Printf("announce post %s: %v", post.ID, err)
+	}
+}
+
+// PostBroadcaster holds the one Redis subscription of this instance and
+// hands every announced post to the clients streaming in memory
+type PostBroadcaster struct {
+	rdb     *redis.Client
+	mu      sync.Mutex
+	clients map[chan PostEvent]bool
+}
+
+func NewPostBroadcaster(rdb *redis.Client) *PostBroadcaster {
+	return &PostBroadcaster{rdb: rdb, clients: map[chan PostEvent]bool{}}
+}
+
+// Run relays announced posts to the clients until ctx is done
+func (b *PostBroadcaster) Run(ctx context.Context) {
+	pubsub := b.rdb.Subscribe(ctx, KEY_POSTS_CHANNEL)
+	defer pubsub.Close()
+	messages := pubsub.Channel()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			eventID, data, _ := strings.Cut(msg.Payload, " ")
+			event := PostEvent{EventID: eventID}
+			if err := json.Unmarshal([]byte(data), &event.Post); err != nil {
+				continue
+			}
+			b.broadcast(event)
+		}
+	}
+}
+
+// broadcast hands event to every client, dropping those too far behind;
+// they reconnect and catch up from their Last-Event-ID
+func (b *PostBroadcaster) broadcast(event PostEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for events := range b.clients {
+		select {
+		case events <- event:
+		default:
+			delete(b.clients, events)
+			close(events)
+		}
+	}
+}
+
+// Subscribe returns the channel new events arrive on, closed when the
+// client falls behind, and a function to stop receiving them
+func (b *PostBroadcaster) Subscribe() (<-chan PostEvent, func()) {
+	events := make(chan PostEvent, streamClientBuffer)
+	b.mu.Lock()
+	b.clients[events] = true
+	b.mu.Unlock()
+
+	return events, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.clients[events] {
+			delete(b.clients, events)
+			close(events)
+		}
+	}
+}
+
+// parseLastEventID checks the event ID a client saw last; "" means none
+func parseLastEventID(lastEventID string) (string, error) {
+	if lastEventID != "" && !streamIDPattern.MatchString(lastEventID) {
+		return "", fmt.Errorf("invalid Last-Event-ID %q", lastEventID)
+	}
+	return lastEventID, nil
+}
+
+// eventAfter reports whether stream ID a comes after stream ID b
+func eventAfter(a, b string) bool {
+	aMs, aSeq, _ := strings.Cut(a, "-")
+	bMs, bSeq, _ := strings.Cut(b, "-")
+	x, _ := strconv.ParseUint(aMs, 10, 64)
+	y, _ := strconv.ParseUint(bMs, 10, 64)
+	if x != y {
+		return x > y
+	}
+	x, _ = strconv.ParseUint(aSeq, 10, 64)
+	y, _ = strconv.ParseUint(bSeq, 10, 64)
+	return x > y
+}
+
+// eventsAfter returns the posts announced after the event lastEventID, in
+// announcement order. Deleted posts are skipped and edited ones are current.
+func eventsAfter(ctx context.Context, rdb *redis.Client, lastEventID string) ([]PostEvent, error) {
+	events := []PostEvent{}
+	for from := lastEventID; ; {
+		entries, err := rdb.XRangeN(ctx, KEY_POSTS_EVENTS, from, "+", maxPageSize).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		ids := []string{}
+		eventIDs := map[string]string{}
+		for _, entry := range entries {
+			// The range includes the event the client already has
+			if entry.ID == lastEventID {
+				continue
+			}
+			id, _ := entry.Values["post"].(string)
+			ids = append(ids, id)
+			eventIDs[id] = entry.ID
+		}
+		posts, err := loadPosts(ctx, rdb, ids)
+		if err != nil {
+			return nil, err
+		}
+		for _, post := range posts {
+			events = append(events, PostEvent{EventID: eventIDs[post.ID], Post: post})
+		}
+
+		if len(entries) < maxPageSize {
+			return events, nil
+		}
+		from = entries[len(entries)-1].ID
+		lastEventID = from
+	}
+}
+
+// streamPosts sends every new post until ctx is done, send fails or the
+// client falls behind. With a lastEventID it first sends the posts
+// announced since then. The client subscribes before that backfill, so
+// nothing is lost in between.
+func streamPosts(ctx context.Context, rdb *redis.Client, broadcaster *PostBroadcaster, lastEventID string, send func(PostEvent) error, keepalive func() error) error {
+	events, unsubscribe := broadcaster.Subscribe()
+	defer unsubscribe()
+
+	// Events the backfill already sent may arrive again live
+	backfilled := lastEventID
+	if lastEventID != "" {
+		missed, err := eventsAfter(ctx, rdb, lastEventID)
+		if err != nil {
+			return err
+		}
+		for _, event := range missed {
+			if err := send(event); err != nil {
+				return err
+			}
+			backfilled = event.EventID
+		}
+	}
+
+	ticker := time.NewTicker(streamKeepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := keepalive(); err != nil {
+				return err
+			}
+		case event, ok := <-events:
+			if !ok {
+				return fmt.Errorf("client fell more than %d posts behind", streamClientBuffer)
+			}
+			if backfilled != "" && !eventAfter(event.EventID, backfilled) {
+				continue
+			}
+			if err := send(event); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Function to stream new posts as Server-Sent Events
+func streamPostsSSE(c *fiber.Ctx, ctx context.Context, rdb *redis.Client, broadcaster *PostBroadcaster) error {
+	lastEventID, err := parseLastEventID(c.Get("Last-Event-ID", c.Query("last_event_id")))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+
+	// The writer runs after this handler returns, so it must not touch c
+	c.Context().SetBodyStreamWriter(fasthttp.StreamWriter(func(w *bufio.Writer) {
+		send := func(event PostEvent) error {
+			data, err := json.Marshal(event.Post)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "id: %s\nevent: post\ndata: %s\n\n", event.EventID, data)
+			return w.Flush()
+		}
+		keepalive := func() error {
+			fmt.Fprint(w, ": keepalive\n\n")
+			return w.Flush()
+		}
+		// Comments are ignored by clients but get the headers out right away
+		if err := keepalive(); err != nil {
+			return
+		}
+		if err := streamPosts(ctx, rdb, broadcaster, lastEventID, send, keepalive); err != nil {
+			log.Printf("sse stream: %v", err)
+		}
+	}))
+
+	return nil
+}
+
+// Function to stream new posts over a WebSocket, one JSON event per message.
+// Browsers cannot set headers on WebSockets, so ?last_event_id= also works.
+func streamPostsWebSocket(ctx context.Context, rdb *redis.Client, broadcaster *PostBroadcaster) fiber.Handler {
+	return websocket.New(func(conn *websocket.Conn) {
+		lastEventID := conn.Query("last_event_id")
+		if header := conn.Headers("Last-Event-ID"); header != "" {
+			lastEventID = header
+		}
+		lastEventID, err := parseLastEventID(lastEventID)
+		if err != nil {
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error()))
+			return
+		}
+
+		// Clients only ever send closes; reading is how we notice them
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go func() {
+			defer cancel()
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		send := func(event PostEvent) error {
+			return conn.WriteJSON(event)
+		}
+		keepalive := func() error {
+			return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamKeepalive))
+		}
+		if err := streamPosts(ctx, rdb, broadcaster, lastEventID, send, keepalive); err != nil {
+			log.Printf("websocket stream: %v", err)
+		}
+	})
+}
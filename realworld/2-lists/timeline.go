@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strconv"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Newest posts kept in the timeline list; older ones move to the archive
+const maxTimelineLength = 1000
+
+// Number of post IDs trimmed off the timeline so far
+const KEY_TRIMMED = "KEY_TESTER:trimmed"
+
+// Stream of posts trimmed off the timeline, oldest first
+const KEY_ARCHIVE = "KEY_TESTER:archive"
+
+// Hash from the ID of each archived post to its entry in KEY_ARCHIVE, so
+// home timelines and author lists that still hold the ID can read it back
+const KEY_ARCHIVE_INDEX = "KEY_TESTER:archive:index"
+
+// Stream entry IDs look like <milliseconds>-<sequence>
+var streamIDPattern = regexp.MustCompile(`^\d+-\d+$`)
+
+// Stores a new post and pushes its ID in one step, unless the post exists (-1), then trims the timeline
+// to ARGV[4] IDs. Every trimmed post that was not deleted is appended to the
+// archive stream, recorded in the archive index KEYS[5] and its hash removed,
+// and every trimmed post is dropped from the search index.
+//
+// Every key touched is passed in KEYS, so the caller reads beforehand which
+// posts the push will trim. For each of them, oldest first, KEYS[6..] hold its
+// hash, its term set and the key of each of its terms, and ARGV[6..] hold its
+// ID, its number of terms and the terms. If the timeline or those term sets
+// changed in the meantime nothing is written and -2 is returned.
+var createPostScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[2]) == 1 then
+	return -1
+end
+
+local tail = redis.call("LRANGE", KEYS[1], tonumber(ARGV[4]) - 1, -1)
+local trims = {}
+local k, a = 6, 6
+for i = #tail, 1, -1 do
+	if ARGV[a] ~= tail[i] then
+		return -2
+	end
+	local trim = {id = ARGV[a], hash = KEYS[k], terms = KEYS[k + 1], termKeys = {}}
+	local expected = {}
+	local count = tonumber(ARGV[a + 1])
+	for j = 1, count do
+		expected[ARGV[a + 1 + j]] = true
+		trim.termKeys[j] = KEYS[k + 1 + j]
+	end
+	local terms = redis.call("SMEMBERS", trim.terms)
+	if #terms ~= count then
+		return -2
+	end
+	for _, term in ipairs(terms) do
+		if not expected[term] then
+			return -2
+		end
+	end
+	trims[#trims + 1] = trim
+	k = k + 2 + count
+	a = a + 2 + count
+end
+if a <= #ARGV then
+	return -2
+end
+
+redis.call("HSET", KEYS[2], "author", ARGV[5], "key", ARGV[2], "value", ARGV[3])
+redis.call("LPUSH", KEYS[1], ARGV[1])
+
+for _, trim in ipairs(trims) do
+	redis.call("RPOP", KEYS[1])
+	local post = redis.call("HMGET", trim.hash, "author", "key", "value")
+	if post[1] or post[2] or post[3] then
+		local entry = redis.call("XADD", KEYS[4], "*", "id", trim.id, "author", post[1] or "", "key", post[2] or "", "value", post[3] or "")
+		redis.call("HSET", KEYS[5], trim.id, entry)
+		redis.call("DEL", trim.hash)
+	end
+	for _, termKey in ipairs(trim.termKeys) do
+		redis.call("ZREM", termKey, trim.id)
+	end
+	redis.call("DEL", trim.terms)
+end
+if #trims > 0 then
+	redis.call("INCRBY", KEYS[3], #trims)
+end
+return #trims
+`)
+
+// Attempts storePost makes while other writers keep changing the timeline's tail
+const maxStoreAttempts = 5
+
+var errTimelineBusy = errors.New("timeline kept changing while storing the post")
+
+// storePost saves a new post at the head of the timeline, archiving whatever
+// falls off its end. It reports false if a post with that ID was already stored.
+func storePost(ctx context.Context, rdb *redis.Client, post Posts) (bool, error) {
+	for attempt := 0; attempt < maxStoreAttempts; attempt++ {
+		keys, args, err := planStorePost(ctx, rdb, post)
+		if err != nil {
+			return false, err
+		}
+		trimmed, err := createPostScript.Run(ctx, rdb, keys, args...).Int()
+		if err != nil {
+			return false, err
+		}
+		if trimmed != -2 {
+			return trimmed >= 0, nil
+		}
+	}
+	return false, errTimelineBusy
+}
+
+// planStorePost reads which posts storing post will trim off the timeline and
+// the terms they are indexed under, and lays them out as createPostScript expects
+func planStorePost(ctx context.Context, rdb *redis.Client, post Posts) ([]string, []interface{}, error) {
+	// After the push every ID from index maxTimelineLength-1 on is past the end
+	tail, err := rdb.LRange(ctx, KEY_TESTER, maxTimelineLength-1, -1).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+	pipe := rdb.Pipeline()
+	termCmds := make([]*redis.StringSliceCmd, len(tail))
+	for i, id := range tail {
+		termCmds[i] = pipe.SMembers(ctx, postTermsKey(id))
+	}
+	if len(tail) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	keys := []string{KEY_TESTER, postKey(post.ID), KEY_TRIMMED, KEY_ARCHIVE, KEY_ARCHIVE_INDEX}
+	args := []interface{}{post.ID, post.Key, post.Value, maxTimelineLength, post.Author}
+	// Posts are trimmed from the tail, so the oldest comes first
+	for i := len(tail) - 1; i >= 0; i-- {
+		id, terms := tail[i], termCmds[i].Val()
+		keys = append(keys, postKey(id), postTermsKey(id))
+		args = append(args, id, len(terms))
+		for _, term := range terms {
+			keys = append(keys, termKey(term))
+			args = append(args, term)
+		}
+	}
+	return keys, args, nil
+}
+
+// Function to page through archived posts, newest first
+func findArchivedPosts(c *fiber.Ctx, ctx context.Context, rdb *redis.Client) error {
+	// Retrieve count of posts per page from query parameters, default to 5 if not provided
+	count, err := strconv.Atoi(c.Query("count", "5"))
+	if err != nil || count <= 0 || count > maxPageSize {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "count must be between 1 and " + strconv.Itoa(maxPageSize)})
+	}
+
+	// The cursor holds the stream ID of the first entry of the page; start at the newest without one
+	from := "+"
+	if cursor := c.Query("cursor"); cursor != "" {
+		from, err = decodeStreamCursor(cursor)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+
+	// Read one entry more than the page size; it becomes the next cursor
+	entries, err := rdb.XRevRangeN(ctx, KEY_ARCHIVE, from, "-", int64(count+1)).Result()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	page := PostsPage{Posts: []Posts{}}
+	if len(entries) > count {
+		page.HasMore = true
+		page.NextCursor = encodeStreamCursor(entries[count].ID)
+		entries = entries[:count]
+	}
+	for _, entry := range entries {
+		page.Posts = append(page.Posts, archivedPost(entry))
+	}
+
+	return c.JSON(page)
+}
+
+// archivedPost reads a post back from its entry in KEY_ARCHIVE
+func archivedPost(entry redis.XMessage) Posts {
+	id, _ := entry.Values["id"].(string)
+	author, _ := entry.Values["author"].(string)
+	key, _ := entry.Values["key"].(string)
+	value, _ := entry.Values["value"].(string)
+	return Posts{ID: id, Author: author, Key: key, Value: value}
+}
+
+// loadArchivedPosts reads the archived posts among ids, keyed by ID
+func loadArchivedPosts(ctx context.Context, rdb *redis.Client, ids []string) (map[string]Posts, error) {
+	entryIDs, err := rdb.HMGet(ctx, KEY_ARCHIVE_INDEX, ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	pipe := rdb.Pipeline()
+	cmds := []*redis.XMessageSliceCmd{}
+	for _, entryID := range entryIDs {
+		if entryID, ok := entryID.(string); ok {
+			cmds = append(cmds, pipe.XRangeN(ctx, KEY_ARCHIVE, entryID, entryID, 1))
+		}
+	}
+	archived := map[string]Posts{}
+	if len(cmds) == 0 {
+		return archived, nil
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	for _, cmd := range cmds {
+		for _, entry := range cmd.Val() {
+			post := archivedPost(entry)
+			archived[post.ID] = post
+		}
+	}
+	return archived, nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gofiber/fiber/v2"
+)
+
+// newPostsApp serves the read and delete routes of /posts from rdb
+func newPostsApp(ctx context.Context, rdb *redis.Client) *fiber.App {
+	app := fiber.New()
+	app.Get("/posts", func(c *fiber.Ctx) error {
+		return findPosts(c, ctx, rdb)
+	})
+	app.Get("/posts/archive", func(c *fiber.Ctx) error {
+		return findArchivedPosts(c, ctx, rdb)
+	})
+	app.Delete("/posts/:id", func(c *fiber.Ctx) error {
+		return deletePosts(c, ctx, rdb)
+	})
+	return app
+}
+
+// publishN publishes n posts whose values are word<ID>, returning their IDs
+func publishN(t *testing.T, ctx context.Context, rdb *redis.Client, n int) []string {
+	t.Helper()
+	ids := make([]string, n)
+	for i := range ids {
+		post := Posts{}
+		if err := assignPostID(ctx, rdb, &post); err != nil {
+			t.Fatal(err)
+		}
+		post.Key = "key" + post.ID
+		post.Value = "word" + post.ID
+		if err := publishPost(ctx, rdb, &post); err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = post.ID
+	}
+	return ids
+}
+
+// postIDs lists the IDs of posts in order
+func postIDs(posts []Posts) []string {
+	ids := []string{}
+	for _, post := range posts {
+		ids = append(ids, post.ID)
+	}
+	return ids
+}
+
+func TestStorePostTrimsAndArchives(t *testing.T) {
+	mr, rdb := newTestRedis(t)
+	ctx := context.Background()
+	app := newPostsApp(ctx, rdb)
+
+	publishN(t, ctx, rdb, maxTimelineLength)
+	if status := doJSON(t, app, http.MethodDelete, "/posts/2", "", nil); status != fiber.StatusOK {
+		t.Fatalf("delete: %d", status)
+	}
+	publishN(t, ctx, rdb, 3)
+
+	// Posts 1 to 3 fell off the end
+	if length := rdb.LLen(ctx, KEY_TESTER).Val(); length != maxTimelineLength {
+		t.Errorf("timeline holds %d IDs, want %d", length, maxTimelineLength)
+	}
+	if trimmed, _ := mr.Get(KEY_TRIMMED); trimmed != "3" {
+		t.Errorf("trimmed = %q, want 3", trimmed)
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		if mr.Exists(postKey(id)) || mr.Exists(postTermsKey(id)) || mr.Exists(termKey("word"+id)) {
+			t.Errorf("post %s still stored or indexed", id)
+		}
+	}
+	if !mr.Exists(postKey("4")) || !mr.Exists(termKey("word4")) {
+		t.Error("post 4 was trimmed too")
+	}
+
+	// Only the posts that were not deleted are archived, newest first
+	page := PostsPage{}
+	doJSON(t, app, http.MethodGet, "/posts/archive?count=1", "", &page)
+	want := []Posts{{ID: "3", Key: "key3", Value: "word3"}}
+	if !reflect.DeepEqual(page.Posts, want) || !page.HasMore || page.NextCursor == "" {
+		t.Fatalf("first archive page = %+v", page)
+	}
+	next := PostsPage{}
+	doJSON(t, app, http.MethodGet, "/posts/archive?count=1&cursor="+page.NextCursor, "", &next)
+	want = []Posts{{ID: "1", Key: "key1", Value: "word1"}}
+	if !reflect.DeepEqual(next.Posts, want) || next.HasMore || next.NextCursor != "" {
+		t.Errorf("second archive page = %+v", next)
+	}
+}
+
+func TestStorePostReplansWhenTrimChanges(t *testing.T) {
+	mr, rdb := newTestRedis(t)
+	ctx := context.Background()
+	publishN(t, ctx, rdb, maxTimelineLength)
+
+	post := Posts{ID: "new", Key: "key", Value: "value"}
+	run := func(keys []string, args []interface{}) int {
+		trimmed, err := createPostScript.Run(ctx, rdb, keys, args...).Int()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return trimmed
+	}
+
+	// Another post pushed post 1 off after the plan was made
+	keys, args, err := planStorePost(ctx, rdb, post)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishN(t, ctx, rdb, 1)
+	if trimmed := run(keys, args); trimmed != -2 {
+		t.Fatalf("stale tail: script = %d, want -2", trimmed)
+	}
+	if mr.Exists(postKey(post.ID)) {
+		t.Fatal("stale plan wrote the post")
+	}
+
+	// Post 2, next to go, was reindexed under other terms after the plan was made
+	keys, args, err = planStorePost(ctx, rdb, post)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := indexPost(ctx, rdb, Posts{ID: "2", Value: "changed"}); err != nil {
+		t.Fatal(err)
+	}
+	if trimmed := run(keys, args); trimmed != -2 {
+		t.Fatalf("stale terms: script = %d, want -2", trimmed)
+	}
+
+	// storePost plans again and drops post 2 from every term it is under now
+	if stored, err := storePost(ctx, rdb, post); err != nil || !stored {
+		t.Fatalf("storePost = %v, %v", stored, err)
+	}
+	if mr.Exists(postKey("2")) || mr.Exists(termKey("changed")) {
+		t.Error("post 2 still stored or indexed")
+	}
+	if stored, err := storePost(ctx, rdb, post); err != nil || stored {
+		t.Errorf("storing again = %v, %v; want false", stored, err)
+	}
+}
+
+func TestFindPostsCursorsAcrossChanges(t *testing.T) {
+	_, rdb := newTestRedis(t)
+	ctx := context.Background()
+	app := newPostsApp(ctx, rdb)
+	publishN(t, ctx, rdb, 10)
+
+	page := func(query string) PostsPage {
+		t.Helper()
+		page := PostsPage{}
+		if status := doJSON(t, app, http.MethodGet, "/posts?"+query, "", &page); status != fiber.StatusOK {
+			t.Fatalf("GET /posts?%s: %d", query, status)
+		}
+		return page
+	}
+	check := func(got PostsPage, want ...string) {
+		t.Helper()
+		if !reflect.DeepEqual(postIDs(got.Posts), want) {
+			t.Errorf("page = %v, want %v", postIDs(got.Posts), want)
+		}
+	}
+
+	first := page("count=3")
+	check(first, "10", "9", "8")
+
+	// New posts do not shift the next page, and a deleted post is skipped
+	publishN(t, ctx, rdb, 2)
+	doJSON(t, app, http.MethodDelete, "/posts/7", "", nil)
+	second := page("count=3&cursor=" + first.NextCursor)
+	check(second, "6", "5", "4")
+
+	// Trimming the oldest posts does not shift it either
+	publishN(t, ctx, rdb, maxTimelineLength-10)
+	if trimmed := rdb.Get(ctx, KEY_TRIMMED).Val(); trimmed != "2" {
+		t.Fatalf("trimmed = %q, want 2", trimmed)
+	}
+	third := page("count=3&cursor=" + second.NextCursor)
+	check(third, "3")
+	if third.HasMore || third.NextCursor != "" {
+		t.Errorf("last page = %+v", third)
+	}
+
+	if status := doJSON(t, app, http.MethodGet, "/posts?cursor=bogus", "", nil); status != fiber.StatusBadRequest {
+		t.Errorf("bogus cursor: %d, want 400", status)
+	}
+}
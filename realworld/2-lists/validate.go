@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Character sets a string field can be restricted to with chars=<name>
+var charsets = map[string]*regexp.Regexp{
+	"slug": regexp.MustCompile(`^[A-Za-z0-9_.:-]*$`),
+	"name": regexp.MustCompile(`^[A-Za-z0-9_-]*$`),
+	// Printable text: no control characters except tab and newlines
+	"text": regexp.MustCompile(`^[^\x00-\x08\x0B\x0C\x0E-\x1F\x7F]*$`),
+}
+
+// Struct for one field that failed validation
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validate checks the string fields of the struct v points to against
+// their `validate` tags and returns every failure, not just the first.
+// Rules, applied in order:
+//   - trim: remove surrounding whitespace first
+//   - required: must not be empty
+//   - max=N: at most N characters
+//   - chars=NAME: only characters of the named charset
+//
+// Tags are expected to have passed checkValidateTags; a rule it would reject
+// fails the field instead of letting invalid input through.
+func validate(v interface{}) []FieldError {
+	errs := []FieldError{}
+
+	value := reflect.ValueOf(v).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		tag := field.Tag.Get("validate")
+		if tag == "" || field.Type.Kind() != reflect.String {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+
+		for _, rule := range strings.Split(tag, ",") {
+			rule, arg, _ := strings.Cut(rule, "=")
+			s := value.Field(i).String()
+
+			message := ""
+			switch rule {
+			case "trim":
+				value.Field(i).SetString(strings.TrimSpace(s))
+			case "required":
+				if s == "" {
+					message = "is required"
+				}
+			case "max":
+				max, err := strconv.Atoi(arg)
+				if err != nil || utf8.RuneCountInString(s) > max {
+					message = fmt.Sprintf("must be at most %d characters", max)
+				}
+			case "chars":
+				charset := charsets[arg]
+				if charset == nil || !charset.MatchString(s) {
+					message = "contains characters that are not allowed"
+				}
+			default:
+				message = "cannot be validated"
+			}
+
+			// Report only the first failing rule of each field
+			if message != "" {
+				errs = append(errs, FieldError{Field: name, Message: message})
+				break
+			}
+		}
+	}
+	return errs
+}
+
+// checkValidateTags reports the first rule in the `validate` tags of the
+// struct v points to that validate does not understand
+func checkValidateTags(v interface{}) error {
+	t := reflect.TypeOf(v).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("validate")
+		if tag == "" {
+			continue
+		}
+		if field.Type.Kind() != reflect.String {
+			return fmt.Errorf("validate: %s is not a string", field.Name)
+		}
+
+		for _, rule := range strings.Split(tag, ",") {
+			rule, arg, _ := strings.Cut(rule, "=")
+			switch rule {
+			case "trim", "required":
+			case "max":
+				if max, err := strconv.Atoi(arg); err != nil || max < 0 {
+					return fmt.Errorf("validate: invalid max %q on %s", arg, field.Name)
+				}
+			case "chars":
+				if charsets[arg] == nil {
+					return fmt.Errorf("validate: unknown charset %q on %s", arg, field.Name)
+				}
+			default:
+				return fmt.Errorf("validate: unknown rule %q on %s", rule, field.Name)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		post Posts
+		want []FieldError
+	}{
+		{
+			name: "valid",
+			post: Posts{Author: "alice", Key: "greeting", Value: "hello\nworld"},
+			want: []FieldError{},
+		},
+		{
+			name: "missing",
+			post: Posts{Key: "  ", Value: ""},
+			want: []FieldError{{"key", "is required"}, {"value", "is required"}},
+		},
+		{
+			name: "too long",
+			post: Posts{Author: strings.Repeat("a", 65), Key: "k", Value: strings.Repeat("é", 5001)},
+			want: []FieldError{{"author", "must be at most 64 characters"}, {"value", "must be at most 5000 characters"}},
+		},
+		{
+			name: "characters",
+			post: Posts{Author: "bob smith", Key: "a/b", Value: "bell\x07"},
+			want: []FieldError{
+				{"author", "contains characters that are not allowed"},
+				{"key", "contains characters that are not allowed"},
+				{"value", "contains characters that are not allowed"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		if got := validate(&tt.post); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: validate = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidateTrims(t *testing.T) {
+	post := Posts{Author: " alice ", Key: "\tgreeting\n", Value: "  hello  "}
+	if errs := validate(&post); len(errs) != 0 {
+		t.Fatalf("validate = %v", errs)
+	}
+	if post.Author != "alice" || post.Key != "greeting" || post.Value != "hello" {
+		t.Errorf("fields not trimmed: %+v", post)
+	}
+}
+
+func TestCheckValidateTags(t *testing.T) {
+	if err := checkValidateTags(&Posts{}); err != nil {
+		t.Errorf("Posts: %v", err)
+	}
+
+	var notString struct {
+		N int `validate:"required"`
+	}
+	if err := checkValidateTags(&notString); err == nil {
+		t.Error("accepted a rule on a non-string field")
+	}
+
+	var (
+		unknownRule struct {
+			S string `validate:"trim,lowercase"`
+		}
+		unknownCharset struct {
+			S string `validate:"chars=emoji"`
+		}
+		badMax struct {
+			S string `validate:"max=ten"`
+		}
+	)
+	for _, v := range []interface{}{&unknownRule, &unknownCharset, &badMax} {
+		if err := checkValidateTags(v); err == nil {
+			t.Errorf("checkValidateTags(%T) accepted invalid tags", v)
+		}
+		// Whatever slips through fails the field rather than panicking
+		if errs := validate(v); len(errs) != 1 {
+			t.Errorf("validate(%T) = %v, want one error", v, errs)
+		}
+	}
+}
@@ -2,11 +2,15 @@ module a
 
 go 1.22.0
 
-require github.com/gofiber/fiber/v2 v2.52.2
+require (
+	github.com/alicebob/miniredis/v2 v2.39.0
+	github.com/gofiber/fiber/v2 v2.52.2
+)
 
 require (
 	github.com/cespare/xxhash/v2 v2.1.2 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
 )
 
 require (
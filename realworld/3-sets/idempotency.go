@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gofiber/fiber/v2"
+)
+
+// How long a response is kept for replay
+const idempotencyTTL = 24 * time.Hour
+
+// How long the claim of a running request outlives its last renewal, so a
+// crashed instance frees the key; the claim is renewed while the request runs
+const idempotencyLockTTL = 30 * time.Second
+
+// Longest Idempotency-Key accepted
+const maxIdempotencyKeyLength = 255
+
+// Struct stored under an idempotency key; Status is 0 while the first request is running
+type idempotentResponse struct {
+	Fingerprint string `json:"fingerprint"`
+	Status      int    `json:"status"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        []byte `json:"body,omitempty"`
+}
+
+// idempotencyKey is where the response to key for this route is stored
+func idempotencyKey(c *fiber.Ctx, key string) string {
+	return "idempotency:" + c.Method() + ":" + c.Path() + ":" + key
+}
+
+// Local set by markApplied
+const idempotencyApplied = "idempotency.applied"
+
+// markApplied tells idempotent that the request has taken effect, so even a
+// server error after this point is stored and replayed rather than run again
+func markApplied(c *fiber.Ctx) {
+	c.Locals(idempotencyApplied, true)
+}
+
+// idempotent replays the stored response when a request is retried with
+// the same Idempotency-Key header. A retry with a different body gets 422,
+// and one arriving while the first is still running gets 409. Server
+// errors are not stored, so the client can retry them for real, unless
+// the handler called markApplied before failing.
+func idempotent(ctx context.Context, rdb *redis.Client) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		key := c.Get("Idempotency-Key")
+		if key == "" {
+			return c.Next()
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Idempotency-Key is too long"})
+		}
+
+		// The same key must always come with the same request
+		sum := sha256.Sum256(append([]byte(c.OriginalURL()+"\n"), c.Body()...))
+		fingerprint := hex.EncodeToString(sum[:])
+		redisKey := idempotencyKey(c, key)
+
+		// Claim the key for this request, or find what an earlier one left
+		pending, _ := json.Marshal(idempotentResponse{Fingerprint: fingerprint})
+		claimed, err := rdb.SetNX(ctx, redisKey, pending, idempotencyLockTTL).Result()
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		if !claimed {
+			return replay(c, ctx, rdb, redisKey, fingerprint)
+		}
+
+		// Run the request, keeping the claim alive however long it takes;
+		// on a failure before it took effect release the key so a retry
+		// runs it again
+		stopRenewing := renewClaim(ctx, rdb, redisKey)
+		err = c.Next()
+		stopRenewing()
+		applied, _ := c.Locals(idempotencyApplied).(bool)
+		if !applied && (err != nil || c.Response().StatusCode() >= fiber.StatusInternalServerError) {
+			rdb.Del(ctx, redisKey)
+			return err
+		}
+		if err != nil {
+			// Let the error handler write the response that gets stored
+			if err := c.App().ErrorHandler(c, err); err != nil {
+				return err
+			}
+		}
+
+		// The request already happened, so failing to store it must not
+		// turn its response into an error; a retry then gets 409 until the
+		// claim expires instead of running twice right away
+		stored, err := json.Marshal(idempotentResponse{
+			Fingerprint: fingerprint,
+			Status:      c.Response().StatusCode(),
+			ContentType: string(c.Response().Header.ContentType()),
+			Body:        c.Response().Body(),
+		})
+		if err == nil {
+			err = rdb.Set(ctx, redisKey, stored, idempotencyTTL).Err()
+		}
+		if err != nil {
+			log.Printf("store idempotent response %s: %v", redisKey, err)
+		}
+		return nil
+	}
+}
+
+// renewClaim keeps extending the claim on redisKey until the returned
+// function is called; once that returns, no renewal can overwrite the TTL
+// of the stored response
+func renewClaim(ctx context.Context, rdb *redis.Client, redisKey string) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(idempotencyLockTTL / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := rdb.PExpire(ctx, redisKey, idempotencyLockTTL).Err(); err != nil {
+					log.Printf("renew idempotency claim %s: %v", redisKey, err)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// replay answers with the response stored under redisKey
+func replay(c *fiber.Ctx, ctx context.Context, rdb *redis.Client, redisKey, fingerprint string) error {
+	data, err := rdb.Get(ctx, redisKey).Bytes()
+	if err == redis.Nil {
+		// The first request failed or its key just expired; ask for a retry
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Request with this Idempotency-Key is being retried, try again"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	stored := idempotentResponse{}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	if stored.Fingerprint != fingerprint {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"error": "Idempotency-Key was already used for a different request"})
+	}
+	if stored.Status == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Request with this Idempotency-Key is still in progress"})
+	}
+
+	c.Set("Idempotent-Replayed", "true")
+	if stored.ContentType != "" {
+		c.Set(fiber.HeaderContentType, stored.ContentType)
+	}
+	return c.Status(stored.Status).Send(stored.Body)
+}
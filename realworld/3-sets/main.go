@@ -33,7 +33,7 @@ func main() {
 	app.Get("/votes", func(c *fiber.Ctx) error {
 		return countVotes(c, ctx, rdb)
 	})
-	app.Post("/votes", func(c *fiber.Ctx) error {
+	app.Post("/votes", idempotent(ctx, rdb), func(c *fiber.Ctx) error {
 		return createVotes(c, ctx, rdb)
 	})
 